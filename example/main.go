@@ -25,6 +25,9 @@ import (
 
 var logLevel uint32
 
+// vncProxy serves every websocket client, shared sessions and input injection only see the sessions of their own Proxy
+var vncProxy *proxy.Proxy
+
 func init() {
 	filename, _ := filepath.Abs("./example/etc/app.yml")
 	yamlFile, err := ioutil.ReadFile(filename)
@@ -43,8 +46,13 @@ func init() {
 }
 
 func main() {
+	vncProxy = NewVNCProxy()
 	http.HandleFunc("/ws", proxyHandler)
 	http.HandleFunc("/ssh", sshHandler)
+	playback := NewPlaybackProxy()
+	http.Handle("/playback", websocket.Handler(playback.ServePlayback))
+	http.HandleFunc("/playback/control", playback.ServePlaybackControl)
+	http.HandleFunc("/screenshot", vncProxy.ServeScreenshot)
 	log.Info("vnc proxy start success ^ - ^  websocket port: " + strconv.Itoa(conf.Conf.AppInfo.Port))
 	if err := http.ListenAndServe(":"+strconv.Itoa(conf.Conf.AppInfo.Port), nil); err != nil {
 		fmt.Println(err)
@@ -87,7 +95,7 @@ func getGID() uint64 {
 func NewVNCProxy() *proxy.Proxy {
 	return proxy.New(&proxy.Config{
 		LogLevel: logLevel,
-		TokenHandler: func(r *http.Request) (addr string, err error) {
+		TokenHandler: func(r *http.Request) (target *proxy.Target, err error) {
 			defer func() {
 				// 处理所有异常，防止panic导致程序关闭
 				if p := recover(); p != nil {
@@ -95,17 +103,26 @@ func NewVNCProxy() *proxy.Proxy {
 				}
 			}()
 			//todo 获取服务地址的方法
-			addr = "127.0.0.1:5900"
+			target = &proxy.Target{Addr: "127.0.0.1:5900"}
 			return
 		},
 	})
 }
 
+func NewPlaybackProxy() *proxy.Proxy {
+	return proxy.New(&proxy.Config{
+		LogLevel: logLevel,
+		PlaybackHandler: func(r *http.Request) (path string, err error) {
+			//todo 校验权限并返回录像文件路径
+			return filepath.Join("./recordings", filepath.Base(r.URL.Query().Get("file"))), nil
+		},
+	})
+}
+
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	uuid, _ := GenerateUUID()
 	hook := proxy.AddTraceIdHook(uuid)
 	defer proxy.RemoveTraceHook(hook)
-	vncProxy := NewVNCProxy()
 	h := websocket.Handler(vncProxy.ServeWS)
 	h.ServeHTTP(w, r)
 }
@@ -161,6 +178,8 @@ func sshHandler(w http.ResponseWriter, r *http.Request) {
 			User:      user,
 			Password:  pwd,
 			Timeout:   5 * time.Second,
+			// the demo connects to any host, configure HostKey in production
+			InsecureIgnoreHostKey: true,
 		}
 	case "key":
 		//路径直接传输私钥有问题 暂不支持
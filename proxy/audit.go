@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+)
+
+// AuditType is the kind of an AuditEvent
+type AuditType string
+
+const (
+	AuditSessionStart AuditType = "session_start"
+	AuditSessionEnd   AuditType = "session_end"
+	AuditKey          AuditType = "key"
+	AuditPointer      AuditType = "pointer"
+	// AuditTypedText carries the text reconstructed from the key events,
+	// it is sent per line and when the session ends
+	AuditTypedText AuditType = "typed_text"
+	// AuditClipboard reports blocked and redacted cut text
+	AuditClipboard AuditType = "clipboard"
+	// AuditExpiryWarning is sent when the client is warned that its session expires soon,
+	// AuditExpired when it is disconnected for being idle or connected for too long
+	AuditExpiryWarning AuditType = "expiry_warning"
+	AuditExpired       AuditType = "expired"
+	// AuditInject reports key events injected by an admin, see ServeInject
+	AuditInject AuditType = "inject"
+)
+
+// AuditEvent is an auditable action of a websocket client
+type AuditEvent struct {
+	Time time.Time
+	Type AuditType
+	// SessionID identifies the peer of the websocket client
+	SessionID string
+	// User is Target.User as resolved by the TokenHandler
+	User string
+	// TraceID is the trace id of the websocket request, see AddTraceIdHook
+	TraceID string
+	// Addr is the vnc backend address, ssh:<host>/<addr> through an ssh host,
+	// reverse:<id> or repeater:<id> for the servers connecting to the proxy
+	Addr string
+
+	// Keysym and Down describe a key event
+	Keysym uint32
+	Down   bool
+	// ButtonMask, X and Y describe a pointer event
+	ButtonMask uint8
+	X, Y       uint16
+
+	// Text is the typed text or the detail of the other events
+	Text string
+}
+
+// AuditSink receives the audit events of all sessions,
+// Audit is called from the goroutines of the sessions and must not block for long
+type AuditSink interface {
+	Audit(e *AuditEvent)
+}
+
+// LogAuditSink writes the audit events to the log, key and pointer events at debug level
+type LogAuditSink struct{}
+
+func (LogAuditSink) Audit(e *AuditEvent) {
+	entry := log.WithContext(context.WithValue(context.Background(), "trace_id", e.TraceID))
+	prefix := fmt.Sprintf("audit %v session=%v user=%v addr=%v", e.Type, e.SessionID, e.User, e.Addr)
+	switch e.Type {
+	case AuditKey:
+		entry.Debugf("%v keysym=%#x down=%v", prefix, e.Keysym, e.Down)
+	case AuditPointer:
+		entry.Debugf("%v buttons=%#x x=%v y=%v", prefix, e.ButtonMask, e.X, e.Y)
+	case AuditTypedText:
+		entry.Infof("%v text=%q", prefix, e.Text)
+	default:
+		entry.Infof("%v %v", prefix, e.Text)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// audit fill in the session details of e and send it to the audit sink
+func (p *peer) audit(e *AuditEvent) {
+	e.Time = time.Now()
+	e.SessionID = p.id
+	e.User = p.t.User
+	e.TraceID = p.traceID
+	e.Addr = p.t.backend()
+	p.auditSink.Audit(e)
+}
+
+// auditInput audit a key or pointer event forwarded to the backend
+func (p *peer) auditInput(msg rfb.Message) {
+	switch m := msg.(type) {
+	case *rfb.KeyEvent:
+		p.auditKey(m.Key, m.Down)
+	case *rfb.QEMUExtendedKeyEvent:
+		p.auditKey(m.Key, m.Down)
+	case *rfb.PointerEvent:
+		p.audit(&AuditEvent{Type: AuditPointer, ButtonMask: m.ButtonMask, X: m.X, Y: m.Y})
+	}
+}
+
+func (p *peer) auditKey(keysym uint32, down bool) {
+	p.audit(&AuditEvent{Type: AuditKey, Keysym: keysym, Down: down})
+	p.typed.key(keysym, down)
+	if p.typed.line || len(p.typed.text) >= maxTypedText {
+		p.flushTyped()
+	}
+}
+
+// flushTyped send the typed text not audited yet
+func (p *peer) flushTyped() {
+	if len(p.typed.text) > 0 {
+		p.audit(&AuditEvent{Type: AuditTypedText, Text: string(p.typed.text)})
+	}
+	p.typed.text = p.typed.text[:0]
+	p.typed.line = false
+}
+
+// maxTypedText is the number of characters after which the typed text is audited without a new line
+const maxTypedText = 1024
+
+// typedText reconstructs the text typed with key events:
+// printable keys are appended, BackSpace removes the last character,
+// and keys pressed with Ctrl, Alt or Super are shown as <Ctrl+c>
+type typedText struct {
+	text []rune
+	// line is set once Return was pressed
+	line bool
+	ctrl bool
+	alt  bool
+}
+
+func (t *typedText) key(keysym uint32, down bool) {
+	switch {
+	case keysym == rfb.KeyControlL || keysym == rfb.KeyControlR:
+		t.ctrl = down
+		return
+	case keysym >= rfb.KeyMetaL && keysym <= rfb.KeyAltR, keysym == rfb.KeySuperL || keysym == rfb.KeySuperR:
+		t.alt = down
+		return
+	case !down, keysym >= rfb.KeyShiftL && keysym <= rfb.KeySuperR:
+		return
+	}
+	switch keysym {
+	case rfb.KeyBackSpace:
+		if len(t.text) > 0 {
+			t.text = t.text[:len(t.text)-1]
+		}
+		return
+	case rfb.KeyReturn, rfb.KeyKPEnter:
+		t.text = append(t.text, '\n')
+		t.line = true
+		return
+	case rfb.KeyTab, rfb.KeyKPTab:
+		t.text = append(t.text, '\t')
+		return
+	}
+	r, ok := keysymRune(keysym)
+	if !ok {
+		return
+	}
+	if t.ctrl || t.alt {
+		modifier := "Ctrl"
+		if !t.ctrl {
+			modifier = "Alt"
+		}
+		t.text = append(t.text, []rune(fmt.Sprintf("<%v+%c>", modifier, r))...)
+		return
+	}
+	t.text = append(t.text, r)
+}
+
+// keysymRune returns the character of a printable keysym
+func keysymRune(keysym uint32) (rune, bool) {
+	switch {
+	case keysym >= 0x20 && keysym <= 0x7e, keysym >= 0xa0 && keysym <= 0xff:
+		// Latin-1 keysyms are the characters themselves
+		return rune(keysym), true
+	case keysym >= 0x01000100 && keysym <= 0x0110ffff:
+		// Unicode keysyms
+		return rune(keysym - 0x01000000), true
+	case keysym == rfb.KeyKPSpace:
+		return ' ', true
+	case keysym >= rfb.KeyKPMultiply && keysym <= rfb.KeyKP9:
+		// KP_Multiply, KP_Add, KP_Separator, KP_Subtract, KP_Decimal, KP_Divide, KP_0 to KP_9
+		return rune("*+,-./0123456789"[keysym-rfb.KeyKPMultiply]), true
+	}
+	return 0, false
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// keyEvent is a key press or release of a typing test
+type keyEvent struct {
+	keysym uint32
+	down   bool
+}
+
+// press returns the events of pressing and releasing the keys one after the other
+func press(keysyms ...uint32) []keyEvent {
+	events := make([]keyEvent, 0, 2*len(keysyms))
+	for _, k := range keysyms {
+		events = append(events, keyEvent{k, true}, keyEvent{k, false})
+	}
+	return events
+}
+
+// with returns the events of pressing the keys while modifier is held down
+func with(modifier uint32, keysyms ...uint32) []keyEvent {
+	events := append([]keyEvent{{modifier, true}}, press(keysyms...)...)
+	return append(events, keyEvent{modifier, false})
+}
+
+func TestTypedText(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []keyEvent
+		want     string
+		wantLine bool
+	}{
+		{"printable", press('h', 'i', ' ', '!'), "hi !", false},
+		{"latin-1", press(0xe9, 0xdf), "éß", false},
+		{"unicode", press(0x01000000 + '€'), "€", false},
+		{"keypad", press(rfb.KeyKP0+4, rfb.KeyKPMultiply+1, rfb.KeyKPSpace), "4+ ", false},
+		{"tab", press('a', rfb.KeyTab, 'b'), "a\tb", false},
+		{"backspace", press('a', 'b', rfb.KeyBackSpace, 'c'), "ac", false},
+		{"backspace of nothing", press(rfb.KeyBackSpace, 'a'), "a", false},
+		{"return", press('l', 's', rfb.KeyReturn), "ls\n", true},
+		{"keypad enter", press('l', 's', rfb.KeyKPEnter), "ls\n", true},
+		{"shift", append(append([]keyEvent{{rfb.KeyShiftL, true}}, press('A')...), keyEvent{rfb.KeyShiftL, false}), "A", false},
+		{"keys without a character", press(rfb.KeyLeft, rfb.KeyF1, rfb.KeyEscape, rfb.KeyDelete), "", false},
+		{"releases only", []keyEvent{{'a', false}, {'b', false}}, "", false},
+		// combinations are shortcuts, not text
+		{"ctrl", append(with(rfb.KeyControlL, 'c'), press('x')...), "<Ctrl+c>x", false},
+		{"right ctrl", with(rfb.KeyControlR, 'v'), "<Ctrl+v>", false},
+		{"alt", with(rfb.KeyAltL, 0xe9), "<Alt+é>", false},
+		{"meta", with(rfb.KeyMetaL, 'f'), "<Alt+f>", false},
+		{"super", with(rfb.KeySuperL, 'l'), "<Alt+l>", false},
+		{"ctrl and alt", append(append([]keyEvent{{rfb.KeyControlL, true}}, with(rfb.KeyAltL, rfb.KeyDelete, 't')...), keyEvent{rfb.KeyControlL, false}), "<Ctrl+t>", false},
+		{"ctrl released", append(with(rfb.KeyControlL), press('a')...), "a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var typed typedText
+			for _, e := range tt.events {
+				typed.key(e.keysym, e.down)
+			}
+			if got := string(typed.text); got != tt.want {
+				t.Fatalf("typed text = %q, want %q", got, tt.want)
+			}
+			if typed.line != tt.wantLine {
+				t.Fatalf("line = %v, want %v", typed.line, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestAuditTypedText(t *testing.T) {
+	var events auditLog
+	p := &peer{t: &Target{}, auditSink: &events}
+	for _, e := range append(press('l', 's', rfb.KeyReturn), press('p', 'w', 'd')...) {
+		p.auditInput(&rfb.KeyEvent{Down: e.down, Key: e.keysym})
+	}
+	p.flushTyped()
+
+	var typed []string
+	for _, e := range events {
+		if e.Type == AuditTypedText {
+			typed = append(typed, e.Text)
+		}
+	}
+	// the line is audited at Return, the rest when the client leaves
+	if len(typed) != 2 || typed[0] != "ls\n" || typed[1] != "pwd" {
+		t.Fatalf("typed text events = %q, want [\"ls\\n\" \"pwd\"]", typed)
+	}
+}
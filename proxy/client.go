@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"context"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	"github.com/pkg/errors"
+)
+
+// ErrClientClosed is returned by a Client after Close
+var ErrClientClosed = errors.New("vnc client closed")
+
+// ErrWaitingTarget is returned by Dial for Reverse and Repeater targets, whose connection waits for a websocket client
+var ErrWaitingTarget = errors.New("reverse and repeater targets are not supported by the vnc client")
+
+// clientPixelFormat is requested by a Client, with 8 bits per colour in 32 bits
+// ZRLE and Tight send the compact 3 bytes pixels
+var clientPixelFormat = rfb.PixelFormat{
+	BPP: 32, Depth: 24, TrueColour: true,
+	RedMax: 255, GreenMax: 255, BlueMax: 255,
+	RedShift: 16, GreenShift: 8, BlueShift: 0,
+}
+
+// clientEncodings are the encodings a Client decodes, most preferred first.
+// No JPEG quality level is sent, so Tight stays lossless.
+var clientEncodings = []int32{
+	rfb.EncodingTight, rfb.EncodingZRLE, rfb.EncodingHextile, rfb.EncodingZlib,
+	rfb.EncodingRRE, rfb.EncodingCoRRE, rfb.EncodingCopyRect, rfb.EncodingRaw,
+	rfb.EncodingDesktopSize, rfb.EncodingLastRect,
+}
+
+// Client is a vnc client of a backend for automation without a browser.
+// It keeps the screen of the backend decoded in memory and sends keyboard and pointer input.
+// The methods of a Client are safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	name string
+	// done is closed when the connection ended, err tells why
+	done chan struct{}
+	err  error
+
+	// wl serializes the messages written to the backend
+	wl sync.Mutex
+
+	l  sync.Mutex
+	fb *rfb.Framebuffer
+	// updates counts the framebuffer updates carrying pixels,
+	// updated is closed and replaced after every framebuffer update
+	updates int
+	updated chan struct{}
+	closed  bool
+}
+
+// Dial connect to the vnc backend of t as a client, authenticating with the credentials of t
+// (security type None, VNC Authentication or VeNCrypt). The backend is asked to share the desktop,
+// so the clients viewing it stay connected. Config.HandshakeTimeout limits the handshake.
+// Reverse and Repeater targets are rejected, a Client would take the connection waiting for the websocket clients.
+func Dial(t *Target, conf *Config) (*Client, error) {
+	if t == nil {
+		return nil, errors.New("vnc backend target is nil")
+	}
+	if t.Reverse != "" || t.Repeater != "" {
+		return nil, ErrWaitingTarget
+	}
+	c, err := dialTarget(t, conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil && conf.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	conn, serverInit, err := clientHandshake(t, c, true)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	cl := &Client{
+		conn:    conn,
+		name:    serverInit.Name,
+		done:    make(chan struct{}),
+		fb:      rfb.NewFramebuffer(int(serverInit.Width), int(serverInit.Height), clientPixelFormat),
+		updated: make(chan struct{}),
+	}
+	requests := []rfb.Message{
+		&rfb.SetPixelFormat{PixelFormat: clientPixelFormat},
+		&rfb.SetEncodings{Encodings: clientEncodings},
+		&rfb.FramebufferUpdateRequest{Width: serverInit.Width, Height: serverInit.Height},
+	}
+	for _, request := range requests {
+		if err = cl.send(request); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go cl.run()
+	return cl, nil
+}
+
+// run decode the framebuffer updates and ask for the next one, until the connection ends
+func (c *Client) run() {
+	r := rfb.NewServerReader(c.conn, clientPixelFormat)
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		fu, ok := msg.(*rfb.FramebufferUpdate)
+		if !ok {
+			continue
+		}
+		c.l.Lock()
+		width, height := c.fb.Width(), c.fb.Height()
+		err = c.fb.Update(fu)
+		if err == nil && hasPixels(fu) {
+			c.updates++
+		}
+		close(c.updated)
+		c.updated = make(chan struct{})
+		// after a resize the whole screen is needed again
+		request := &rfb.FramebufferUpdateRequest{
+			Incremental: width == c.fb.Width() && height == c.fb.Height(),
+			Width:       uint16(c.fb.Width()),
+			Height:      uint16(c.fb.Height()),
+		}
+		c.l.Unlock()
+		if err != nil {
+			c.fail(&ProtocolError{Msg: "FramebufferUpdate", Err: err})
+			return
+		}
+		if err = c.send(request); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// fail end the client for err
+func (c *Client) fail(err error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	switch {
+	case c.closed:
+		err = ErrClientClosed
+	case err == io.EOF:
+		err = ErrBackendClosed
+	case isParseError(err):
+		err = &ProtocolError{Msg: "server message", Err: err}
+	default:
+		if _, ok := err.(*ProtocolError); !ok {
+			err = classify(ErrBackendClosed, err)
+		}
+	}
+	c.err = err
+	close(c.done)
+}
+
+// Close disconnect from the backend
+func (c *Client) Close() error {
+	c.l.Lock()
+	c.closed = true
+	c.l.Unlock()
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Done returns a channel which is closed when the connection ended, Err tells why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, or nil while it is open
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Name returns the desktop name of the backend
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Image returns a copy of the screen
+func (c *Client) Image() *image.RGBA {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.fb.Image()
+}
+
+// WaitUpdate wait until the screen was updated after the call
+func (c *Client) WaitUpdate(ctx context.Context) error {
+	c.l.Lock()
+	updates := c.updates
+	c.l.Unlock()
+	return c.waitFor(ctx, func() bool { return c.updates > updates })
+}
+
+// WaitMatch wait until the region of the screen at `at` matches ref, every colour component
+// may differ by tolerance. Only the opaque pixels of ref are compared, so that transparent pixels
+// can mask the parts of the region which change.
+func (c *Client) WaitMatch(ctx context.Context, at image.Point, ref image.Image, tolerance uint8) error {
+	return c.waitFor(ctx, func() bool { return c.matches(at, ref, tolerance) })
+}
+
+// waitFor wait until cond, which is called with c.l held, is true after a framebuffer update.
+// It returns the error of ctx or of the connection when either ends first.
+func (c *Client) waitFor(ctx context.Context, cond func() bool) error {
+	for {
+		c.l.Lock()
+		ok := cond()
+		updated := c.updated
+		c.l.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) matches(at image.Point, ref image.Image, tolerance uint8) bool {
+	b := ref.Bounds()
+	if c.updates == 0 || !b.Sub(b.Min).Add(at).In(image.Rect(0, 0, c.fb.Width(), c.fb.Height())) {
+		return false
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := ref.At(x, y).RGBA()
+			if a != 0xffff {
+				continue
+			}
+			got := c.fb.RGBAAt(at.X+x-b.Min.X, at.Y+y-b.Min.Y)
+			if colourDistance(uint8(r>>8), got.R) > tolerance ||
+				colourDistance(uint8(g>>8), got.G) > tolerance ||
+				colourDistance(uint8(bl>>8), got.B) > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func colourDistance(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// KeyEvent press or release the key of keysym, see the rfb.Key constants and rfb.Keysym
+func (c *Client) KeyEvent(keysym uint32, down bool) error {
+	return c.send(&rfb.KeyEvent{Down: down, Key: keysym})
+}
+
+// Press press the keys in order and release them in reverse order,
+// e.g. Press(rfb.KeyControlL, rfb.KeyAltL, rfb.KeyDelete)
+func (c *Client) Press(keysyms ...uint32) error {
+	return c.sendKeys(pressEvents(keysyms...))
+}
+
+// Type type text key by key, see rfb.Keysym
+func (c *Client) Type(text string) error {
+	return c.sendKeys(typeEvents(text))
+}
+
+// PointerEvent move the pointer to x, y with the buttons of the mask pressed, bit 0 is the left button
+func (c *Client) PointerEvent(buttons uint8, x, y int) error {
+	return c.send(&rfb.PointerEvent{ButtonMask: buttons, X: uint16(x), Y: uint16(y)})
+}
+
+// Click press and release the buttons at x, y
+func (c *Client) Click(buttons uint8, x, y int) error {
+	if err := c.PointerEvent(buttons, x, y); err != nil {
+		return err
+	}
+	return c.PointerEvent(0, x, y)
+}
+
+func (c *Client) sendKeys(events []*rfb.KeyEvent) error {
+	for _, e := range events {
+		if err := c.send(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) send(msg rfb.Message) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	_, err := c.conn.Write(msg.Bytes())
+	return err
+}
+
+// pressEvents returns the key events pressing the keys in order and releasing them in reverse order
+func pressEvents(keysyms ...uint32) []*rfb.KeyEvent {
+	events := make([]*rfb.KeyEvent, 0, 2*len(keysyms))
+	for _, keysym := range keysyms {
+		events = append(events, &rfb.KeyEvent{Down: true, Key: keysym})
+	}
+	for i := len(keysyms) - 1; i >= 0; i-- {
+		events = append(events, &rfb.KeyEvent{Down: false, Key: keysyms[i]})
+	}
+	return events
+}
+
+// typeEvents returns the key events typing text
+func typeEvents(text string) []*rfb.KeyEvent {
+	events := make([]*rfb.KeyEvent, 0, 2*len(text))
+	for _, r := range text {
+		events = append(events, pressEvents(rfb.Keysym(r))...)
+	}
+	return events
+}
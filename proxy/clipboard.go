@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// ClipboardPolicy decides in which directions the clipboard is transferred
+type ClipboardPolicy int
+
+const (
+	// ClipboardBoth transfers cut text in both directions
+	ClipboardBoth ClipboardPolicy = iota
+	// ClipboardServerToClient only transfers the clipboard of the vnc backend to the client
+	ClipboardServerToClient
+	// ClipboardClientToServer only transfers the clipboard of the client to the vnc backend
+	ClipboardClientToServer
+	// ClipboardNone blocks the clipboard in both directions
+	ClipboardNone
+)
+
+// allows reports whether cut text sent by the client (or by the server) is transferred
+func (c ClipboardPolicy) allows(fromClient bool) bool {
+	switch c {
+	case ClipboardBoth:
+		return true
+	case ClipboardServerToClient:
+		return !fromClient
+	case ClipboardClientToServer:
+		return fromClient
+	}
+	return false
+}
+
+// FilterAction is what a ClipboardFilter does with matching cut text
+type FilterAction int
+
+const (
+	// FilterRedact replaces the matches with the Replacement of the filter
+	FilterRedact FilterAction = iota
+	// FilterBlock drops the whole cut text
+	FilterBlock
+)
+
+// DefaultReplacement replaces the matches of a redacting filter without Replacement
+const DefaultReplacement = "[REDACTED]"
+
+// ClipboardFilter scans the cut text of both directions for sensitive content,
+// e.g. credit card numbers, API keys or internal hostnames
+type ClipboardFilter struct {
+	// Name identifies the filter in the audit log
+	Name    string
+	Pattern *regexp.Regexp
+	Action  FilterAction
+	// Replacement replaces the matches when Action is FilterRedact, defaults to DefaultReplacement
+	Replacement string
+}
+
+// filterClipboard applies the clipboard policy and the clipboard filters of the peer
+// to the legacy or extended payload of a cut text message
+func (p *peer) filterClipboard(fromClient bool, payload []byte, extended bool) ([]byte, bool) {
+	if extended {
+		return p.filterExtendedClipboard(fromClient, payload)
+	}
+	return p.filterCutText(fromClient, payload)
+}
+
+// filterCutText applies the clipboard policy and the clipboard filters of the peer to legacy cut text.
+// It returns the text to transfer, which may be redacted, and false if the transfer is blocked.
+func (p *peer) filterCutText(fromClient bool, text []byte) ([]byte, bool) {
+	direction := clipboardDirection(fromClient)
+	if !p.allowClipboard(fromClient, len(text)) {
+		return nil, false
+	}
+	// legacy cut text is Latin-1, the patterns match UTF-8
+	filtered, ok, redacted := p.filterText(direction, latin1ToUTF8(text))
+	switch {
+	case !ok:
+		return nil, false
+	case redacted:
+		return utf8ToLatin1(filtered), true
+	}
+	return text, true
+}
+
+// filterExtendedClipboard applies the clipboard policy and the clipboard filters of the peer
+// to the payload of an extended cut text message. Only the UTF-8 text of a provide message
+// is scanned, the other formats are dropped when the peer has filters.
+// It returns the payload to transfer and false if the message is blocked.
+func (p *peer) filterExtendedClipboard(fromClient bool, payload []byte) ([]byte, bool) {
+	direction := clipboardDirection(fromClient)
+	ec, err := rfb.ParseExtendedClipboardLimit(payload, p.maxCutText(fromClient))
+	if err != nil {
+		p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v dropped: %v", direction, err)})
+		return nil, false
+	}
+	switch ec.Action() {
+	case rfb.ClipboardRequest, rfb.ClipboardPeek:
+		// asks the other side to provide its clipboard
+		if !p.t.Clipboard.allows(!fromClient) {
+			p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v clipboard request blocked by policy", direction)})
+			return nil, false
+		}
+	case rfb.ClipboardNotify:
+		if !p.t.Clipboard.allows(fromClient) {
+			p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v clipboard notification blocked by policy", direction)})
+			return nil, false
+		}
+	case rfb.ClipboardProvide:
+		if !p.allowClipboard(fromClient, ec.Size()) {
+			return nil, false
+		}
+		if len(p.filters) == 0 {
+			break
+		}
+		text, hasText := ec.Text()
+		filtered := &rfb.ExtendedClipboard{Flags: rfb.ClipboardProvide}
+		if hasText {
+			var ok bool
+			text, ok, _ = p.filterText(direction, text)
+			if !ok {
+				return nil, false
+			}
+			filtered.SetText(text)
+		}
+		return filtered.Bytes(), true
+	}
+	return payload, true
+}
+
+// allowClipboard applies the direction and the size limit of the clipboard policy, blocked transfers are audited
+func (p *peer) allowClipboard(fromClient bool, size int) bool {
+	direction := clipboardDirection(fromClient)
+	switch {
+	case !p.t.Clipboard.allows(fromClient):
+		p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v blocked by policy, %d bytes dropped", direction, size)})
+		return false
+	case p.t.ClipboardMaxSize > 0 && size > p.t.ClipboardMaxSize:
+		p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v exceeds %d bytes, %d bytes dropped", direction, p.t.ClipboardMaxSize, size)})
+		return false
+	}
+	return true
+}
+
+// maxCutText is the largest cut text the peer accepts, the cut text of the client is
+// limited to rfb.MaxClientCutTextLength even without ClipboardMaxSize
+func (p *peer) maxCutText(fromClient bool) int {
+	max := p.t.ClipboardMaxSize
+	if fromClient && (max <= 0 || max > rfb.MaxClientCutTextLength) {
+		return rfb.MaxClientCutTextLength
+	}
+	if max <= 0 {
+		return rfb.MaxPayloadLength
+	}
+	return max
+}
+
+// dropCutText audits client cut text the reader skipped for exceeding maxCutText
+func (p *peer) dropCutText(size uint32) {
+	p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v exceeds %d bytes, %d bytes dropped", clipboardDirection(true), p.maxCutText(true), size)})
+}
+
+// filterText applies the clipboard filters of the peer to text, it returns the text to transfer,
+// false if it is blocked and whether it was redacted. Blocked and redacted transfers are audited.
+func (p *peer) filterText(direction, text string) (string, bool, bool) {
+	if len(p.filters) == 0 {
+		return text, true, false
+	}
+	filtered, matched, blocked := applyFilters(p.filters, text)
+	switch {
+	case blocked:
+		p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v blocked by filters %v, %d bytes dropped", direction, matched, len(text))})
+		return "", false, false
+	case len(matched) > 0:
+		p.audit(&AuditEvent{Type: AuditClipboard, Text: fmt.Sprintf("%v redacted by filters %v", direction, matched)})
+		return filtered, true, true
+	}
+	return text, true, false
+}
+
+func clipboardDirection(fromClient bool) string {
+	if fromClient {
+		return "client => server"
+	}
+	return "server => client"
+}
+
+// applyFilters returns the text with the matches of redacting filters replaced,
+// the names of the matching filters, and whether a blocking filter matched
+func applyFilters(filters []ClipboardFilter, text string) (string, []string, bool) {
+	var (
+		matched []string
+		blocked bool
+	)
+	for _, f := range filters {
+		if f.Pattern == nil || !f.Pattern.MatchString(text) {
+			continue
+		}
+		matched = append(matched, f.Name)
+		if f.Action == FilterBlock {
+			blocked = true
+			continue
+		}
+		replacement := f.Replacement
+		if replacement == "" {
+			replacement = DefaultReplacement
+		}
+		text = f.Pattern.ReplaceAllLiteralString(text, replacement)
+	}
+	return text, matched, blocked
+}
+
+func latin1ToUTF8(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// utf8ToLatin1 converts text back to Latin-1, characters outside of it become '?'
+func utf8ToLatin1(s string) []byte {
+	b := make([]byte, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
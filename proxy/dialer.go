@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer opens the connections to the vnc backends, network is Target.Network and addr is Target.Addr.
+// *net.Dialer and the dialers of golang.org/x/net/proxy are Dialers.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DialerFunc is a function used as a Dialer
+type DialerFunc func(network, addr string) (net.Conn, error)
+
+func (f DialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// Dialers dial each network with its own Dialer, e.g. to add a custom network next to tcp and unix
+type Dialers map[string]Dialer
+
+func (d Dialers) Dial(network, addr string) (net.Conn, error) {
+	dialer, ok := d[network]
+	if !ok {
+		return nil, errors.Errorf("unsupported network %q", network)
+	}
+	return dialer.Dial(network, addr)
+}
+
+// TCPDialer dials tcp backends
+type TCPDialer struct {
+	// Timeout limits the connect, defaults to 5 seconds
+	Timeout time.Duration
+	// KeepAlive is the keepalive period of the connections, defaults to 30 seconds,
+	// a negative value disables keepalive
+	KeepAlive time.Duration
+}
+
+func (d *TCPDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = 5 * time.Second
+	}
+	if dialer.KeepAlive == 0 {
+		dialer.KeepAlive = 30 * time.Second
+	}
+	return dialer.Dial(network, addr)
+}
+
+// UnixDialer dials backends listening on a unix socket, e.g. qemu -vnc unix:/run/vm.sock
+type UnixDialer struct {
+	// Timeout limits the connect, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+func (d *UnixDialer) Dial(network, addr string) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return net.DialTimeout("unix", addr, timeout)
+}
+
+// defaultDialers is the Dialer when Config.Dialer is nil
+var defaultDialers = Dialers{
+	"tcp":  &TCPDialer{},
+	"tcp4": &TCPDialer{},
+	"tcp6": &TCPDialer{},
+	"unix": &UnixDialer{},
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// echoUnixServer echoes what its clients send on a unix socket
+func echoUnixServer(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "vm.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDefaultDialers(t *testing.T) {
+	tcp, stopTCP := echoServer(t)
+	defer stopTCP()
+	unix, stopUnix := echoUnixServer(t)
+	defer stopUnix()
+
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{"tcp", "tcp", tcp, false},
+		{"tcp4", "tcp4", tcp, false},
+		{"unix", "unix", unix, false},
+		{"missing unix socket", "unix", unix + ".missing", true},
+		{"unsupported network", "udp", tcp, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := defaultDialers.Dial(tt.network, tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					c.Close()
+					t.Fatal("Dial() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer c.Close()
+			expectEcho(t, c)
+		})
+	}
+}
+
+func TestDialTargetDialer(t *testing.T) {
+	backend, stop := echoServer(t)
+	defer stop()
+
+	tests := []struct {
+		name        string
+		t           *Target
+		wantNetwork string
+	}{
+		{"tcp by default", &Target{Addr: "vm-1"}, "tcp"},
+		{"custom network", &Target{Network: "vsock", Addr: "vm-1"}, "vsock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var network, addr string
+			conf := &Config{Dialer: DialerFunc(func(n, a string) (net.Conn, error) {
+				network, addr = n, a
+				return net.Dial("tcp", backend)
+			})}
+			c, err := dialTarget(tt.t, conf)
+			if err != nil {
+				t.Fatalf("dialTarget() error = %v", err)
+			}
+			defer c.Close()
+			if network != tt.wantNetwork || addr != tt.t.Addr {
+				t.Fatalf("dialTarget() dialed %v %v, want %v %v", network, addr, tt.wantNetwork, tt.t.Addr)
+			}
+			expectEcho(t, c)
+		})
+	}
+}
+
+func TestDialTargetUnreachable(t *testing.T) {
+	conf := &Config{Dialer: Dialers{"tcp": DialerFunc(func(network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	})}}
+	tests := []struct {
+		name string
+		t    *Target
+	}{
+		{"dial failed", &Target{Addr: "vm-1"}},
+		{"unsupported network", &Target{Network: "unix", Addr: "/run/vm.sock"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := dialTarget(tt.t, conf)
+			if !errors.Is(err, ErrBackendUnreachable) {
+				t.Fatalf("dialTarget() error = %v, want %v", err, ErrBackendUnreachable)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrMalformed reports an RFB message whose content is invalid
+var ErrMalformed = errors.New("malformed message")
+
+// ProtocolError reports a truncated or malformed RFB handshake message
+type ProtocolError struct {
+	// Msg is the name of the RFB message being read, e.g. ProtocolVersion
+	Msg string
+	// Err is io.EOF, io.ErrUnexpectedEOF, ErrMalformed or the network error
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("read RFB %v failed: %v", e.Msg, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the message was not received before the handshake deadline
+func (e *ProtocolError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// errors classifying why a session failed or ended,
+// each of them is reported to the client with its own websocket close code
+var (
+	ErrTokenRejected       = errors.New("token rejected")
+	ErrBackendUnreachable  = errors.New("vnc backend unreachable")
+	ErrBackendRefused      = errors.New("vnc backend refused the connection")
+	ErrUnsupportedSecurity = errors.New("unsupported vnc security type")
+	ErrAuthFailed          = errors.New("vnc authentication failed")
+	ErrTLS                 = errors.New("TLS handshake with vnc backend failed")
+	ErrIdleTimeout         = errors.New("session idle timeout")
+	ErrKicked              = errors.New("session kicked by admin")
+	ErrBackendClosed       = errors.New("vnc backend closed the connection")
+	ErrPeerTooSlow         = errors.New("client too slow for the shared session")
+	ErrSessionExpired      = errors.New("session duration exceeded")
+	ErrInvalidPlayback     = errors.New("invalid playback parameters")
+	ErrIncompatibleClient  = errors.New("client pixel format incompatible with the shared session")
+	ErrAnonymousTLS        = errors.New("vnc backend offers only anonymous TLS, configure x509 credentials on it")
+)
+
+// websocket close codes sent to the client, 4000-4999 are reserved for applications
+const (
+	CloseNormal              = 1000
+	CloseInternalError       = 1011
+	CloseTokenRejected       = 4001
+	CloseBackendUnreachable  = 4002
+	CloseBackendRefused      = 4003
+	CloseUnsupportedSecurity = 4004
+	CloseAuthFailed          = 4005
+	CloseTLS                 = 4006
+	CloseProtocolError       = 4007
+	CloseIdleTimeout         = 4008
+	CloseKicked              = 4009
+	CloseBackendClosed       = 4010
+	ClosePeerTooSlow         = 4011
+	CloseSessionExpired      = 4012
+	CloseInvalidPlayback     = 4013
+	CloseIncompatibleClient  = 4014
+	CloseAnonymousTLS        = 4015
+)
+
+var closeCodes = []struct {
+	err  error
+	code int
+}{
+	{ErrTokenRejected, CloseTokenRejected},
+	{ErrBackendUnreachable, CloseBackendUnreachable},
+	{ErrBackendRefused, CloseBackendRefused},
+	{ErrUnsupportedSecurity, CloseUnsupportedSecurity},
+	{ErrAuthFailed, CloseAuthFailed},
+	{ErrTLS, CloseTLS},
+	{ErrIdleTimeout, CloseIdleTimeout},
+	{ErrKicked, CloseKicked},
+	{ErrBackendClosed, CloseBackendClosed},
+	{ErrPeerTooSlow, ClosePeerTooSlow},
+	{ErrSessionExpired, CloseSessionExpired},
+	{ErrInvalidPlayback, CloseInvalidPlayback},
+	{ErrIncompatibleClient, CloseIncompatibleClient},
+	{ErrAnonymousTLS, CloseAnonymousTLS},
+}
+
+// CloseCode returns the websocket close code and reason reported to the client for err.
+// The reason only names the kind of failure, details stay in the proxy log.
+func CloseCode(err error) (int, string) {
+	if err == nil {
+		return CloseNormal, ""
+	}
+	for _, c := range closeCodes {
+		if errors.Is(err, c.err) {
+			return c.code, c.err.Error()
+		}
+	}
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return CloseProtocolError, "vnc protocol error"
+	}
+	return CloseInternalError, "internal proxy error"
+}
+
+// classify wraps err with the kind of failure it is
+func classify(kind error, err error) error {
+	return fmt.Errorf("%w: %v", kind, err)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// expiry limits how long a peer stays connected
+type expiry struct {
+	// idle disconnects the peer when it sent no input for this long
+	idle time.Duration
+	// max disconnects the peer this long after it connected
+	max time.Duration
+	// warning rings the bell of the client this long before the peer is disconnected
+	warning time.Duration
+}
+
+// expiryOf returns the limits of a peer of t, the limits of t override those of the config
+func expiryOf(conf *Config, t *Target) expiry {
+	var e expiry
+	if conf != nil {
+		e = expiry{idle: conf.IdleTimeout, max: conf.MaxSessionDuration, warning: conf.ExpiryWarning}
+	}
+	if t.IdleTimeout != 0 {
+		e.idle = t.IdleTimeout
+	}
+	if t.MaxSessionDuration != 0 {
+		e.max = t.MaxSessionDuration
+	}
+	return e
+}
+
+// deadline returns when the peer expires and why, or a zero time when it never does
+func (e expiry) deadline(start, lastInput time.Time) (time.Time, error) {
+	var (
+		deadline time.Time
+		reason   error
+	)
+	if e.max > 0 {
+		deadline, reason = start.Add(e.max), ErrSessionExpired
+	}
+	if e.idle > 0 {
+		idle := lastInput.Add(e.idle)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline, reason = idle, ErrIdleTimeout
+		}
+	}
+	return deadline, reason
+}
+
+// expire disconnect the peer once it is idle or connected for too long, until the peer is stopped.
+// The client is warned with a bell before.
+func (p *peer) expire(e expiry) {
+	start := time.Now()
+	var warned time.Time
+	for {
+		deadline, reason := e.deadline(start, p.lastInputTime())
+		if deadline.IsZero() {
+			return
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			p.audit(&AuditEvent{Type: AuditExpired, Text: reason.Error()})
+			p.closeWith(reason)
+			return
+		}
+		if e.warning > 0 && !deadline.Equal(warned) {
+			if wait <= e.warning {
+				warned = deadline
+				p.audit(&AuditEvent{Type: AuditExpiryWarning, Text: fmt.Sprintf("%v in %v", reason, wait.Round(100*time.Millisecond))})
+				p.send((&rfb.Bell{}).Bytes(), p.session.key != "")
+				continue
+			}
+			wait -= e.warning
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-p.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// touch record the time of an input message of the client
+func (p *peer) touch() {
+	p.l.Lock()
+	p.lastInput = time.Now()
+	p.l.Unlock()
+}
+
+func (p *peer) lastInputTime() time.Time {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.lastInput
+}
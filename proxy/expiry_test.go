@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+func TestExpiryDeadline(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		e          expiry
+		lastInput  time.Time
+		want       time.Time
+		wantReason error
+	}{
+		{"no limit", expiry{}, start, time.Time{}, nil},
+		{"max", expiry{max: time.Hour}, start.Add(time.Minute), start.Add(time.Hour), ErrSessionExpired},
+		{"idle", expiry{idle: time.Minute}, start.Add(time.Minute), start.Add(2 * time.Minute), ErrIdleTimeout},
+		{"idle first", expiry{idle: time.Minute, max: time.Hour}, start.Add(time.Minute), start.Add(2 * time.Minute), ErrIdleTimeout},
+		{"max first", expiry{idle: time.Minute, max: time.Hour}, start.Add(time.Hour), start.Add(time.Hour), ErrSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.e.deadline(start, tt.lastInput)
+			if !got.Equal(tt.want) || reason != tt.wantReason {
+				t.Fatalf("deadline() = %v, %v, want %v, %v", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestExpiryOf(t *testing.T) {
+	conf := &Config{IdleTimeout: time.Minute, MaxSessionDuration: time.Hour, ExpiryWarning: time.Second}
+	if got, want := expiryOf(conf, &Target{}), (expiry{idle: time.Minute, max: time.Hour, warning: time.Second}); got != want {
+		t.Fatalf("expiryOf() = %+v, want the limits of the config %+v", got, want)
+	}
+	got := expiryOf(conf, &Target{IdleTimeout: 2 * time.Minute, MaxSessionDuration: 2 * time.Hour})
+	if want := (expiry{idle: 2 * time.Minute, max: 2 * time.Hour, warning: time.Second}); got != want {
+		t.Fatalf("expiryOf() = %+v, want the limits of the target %+v", got, want)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	const (
+		limit   = 300 * time.Millisecond
+		warning = 200 * time.Millisecond
+	)
+	tests := []struct {
+		name string
+		conf *Config
+		// input is how long the client keeps typing
+		input time.Duration
+		// closed is when the session ends at the earliest and latest
+		closedAfter, closedBefore time.Duration
+		wantCode                  int
+	}{
+		{"max duration", &Config{MaxSessionDuration: limit, ExpiryWarning: warning}, 0, limit, 2 * limit, CloseSessionExpired},
+		{"max duration with input", &Config{MaxSessionDuration: limit, ExpiryWarning: warning}, 2 * limit, limit, 2 * limit, CloseSessionExpired},
+		{"idle", &Config{IdleTimeout: limit, ExpiryWarning: warning}, 0, limit, 2 * limit, CloseIdleTimeout},
+		// the last key event is sent up to limit/6 before the input ends
+		{"idle after input", &Config{IdleTimeout: limit, ExpiryWarning: warning}, limit, 2*limit - limit/6, 3 * limit, CloseIdleTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startBackend(t, false)
+			defer backend.close()
+			tt.conf.TokenHandler = func(r *http.Request) (*Target, error) {
+				return &Target{Addr: backend.addr()}, nil
+			}
+			_, url, stop := serveWS(t, tt.conf)
+			defer stop()
+
+			c := connectWS(t, url)
+			defer c.Close()
+			start := time.Now()
+			input := tt.input
+			go func() {
+				for time.Since(start) < input {
+					c.Write((&rfb.KeyEvent{Key: 'a'}).Bytes())
+					time.Sleep(limit / 6)
+				}
+			}()
+
+			if b := c.read(t, 1); b[0] != rfb.BellMsg {
+				t.Fatalf("the client received message type %d, want the warning bell", b[0])
+			}
+			warned := time.Now()
+			if code := c.closeCode(t); code != tt.wantCode {
+				t.Fatalf("close code = %d, want %d", code, tt.wantCode)
+			}
+			closed := time.Now()
+			if d := closed.Sub(warned); d < warning/2 {
+				t.Fatalf("the bell rang %v before the session ended, want about %v", d, warning)
+			}
+			if d := closed.Sub(start); d < tt.closedAfter || d > tt.closedBefore {
+				t.Fatalf("the session ended after %v, want between %v and %v", d, tt.closedAfter, tt.closedBefore)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+	"github.com/pkg/errors"
+)
+
+// AdminHandler authorizes the admin requests of ServeInject, an error rejects the request
+type AdminHandler func(r *http.Request) error
+
+// keyNames are the key names of the combos of ServeInject, single characters are their own keys
+var keyNames = map[string]uint32{
+	"ctrl": rfb.KeyControlL, "control": rfb.KeyControlL,
+	"alt": rfb.KeyAltL, "shift": rfb.KeyShiftL, "meta": rfb.KeyMetaL,
+	"super": rfb.KeySuperL, "win": rfb.KeySuperL,
+	"del": rfb.KeyDelete, "delete": rfb.KeyDelete, "backspace": rfb.KeyBackSpace,
+	"enter": rfb.KeyReturn, "return": rfb.KeyReturn, "tab": rfb.KeyTab,
+	"esc": rfb.KeyEscape, "escape": rfb.KeyEscape, "space": ' ',
+	"insert": rfb.KeyInsert, "home": rfb.KeyHome, "end": rfb.KeyEnd,
+	"pageup": rfb.KeyPageUp, "pagedown": rfb.KeyPageDown,
+	"left": rfb.KeyLeft, "up": rfb.KeyUp, "right": rfb.KeyRight, "down": rfb.KeyDown,
+	"print": rfb.KeyPrint, "sysrq": rfb.KeySysReq, "pause": rfb.KeyPause, "menu": rfb.KeyMenu,
+	"f1": rfb.KeyF1, "f2": rfb.KeyF2, "f3": rfb.KeyF3, "f4": rfb.KeyF4,
+	"f5": rfb.KeyF5, "f6": rfb.KeyF6, "f7": rfb.KeyF7, "f8": rfb.KeyF8,
+	"f9": rfb.KeyF9, "f10": rfb.KeyF10, "f11": rfb.KeyF11, "f12": rfb.KeyF12,
+}
+
+// parseCombo parses a key combination like ctrl+alt+del into its keysyms
+func parseCombo(combo string) ([]uint32, error) {
+	var keysyms []uint32
+	for _, name := range strings.Split(combo, "+") {
+		if keysym, ok := keyNames[strings.ToLower(name)]; ok {
+			keysyms = append(keysyms, keysym)
+			continue
+		}
+		runes := []rune(name)
+		if len(runes) != 1 {
+			return nil, errors.Errorf("unknown key %q in combo %q", name, combo)
+		}
+		keysyms = append(keysyms, rfb.Keysym(runes[0]))
+	}
+	return keysyms, nil
+}
+
+// parseKeysyms parses a comma separated list of keysyms, in hexadecimal with the 0x prefix or decimal
+func parseKeysyms(list string) ([]uint32, error) {
+	var keysyms []uint32
+	for _, v := range strings.Split(list, ",") {
+		keysym, err := strconv.ParseUint(strings.TrimSpace(v), 0, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid keysym %q", v)
+		}
+		keysyms = append(keysyms, uint32(keysym))
+	}
+	return keysyms, nil
+}
+
+// ServeInject inject key events into the session of the peer with the id parameter on behalf of an admin,
+// the request is authorized by Config.AdminHandler. The events are given by the POST form values
+//
+//	combo    key combinations like ctrl+alt+del or ctrl+alt+f2, may be repeated
+//	keysyms  keysyms like 0xffe3,0x63 pressed in order and released in reverse order
+//	text     literal text typed key by key
+//
+// and are injected in this order, whatever the read-only and input policies of the session.
+func (p *Proxy) ServeInject(w http.ResponseWriter, r *http.Request) {
+	if p.conf.AdminHandler == nil {
+		http.Error(w, "admin api is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.conf.AdminHandler(r); err != nil {
+		http.Error(w, "admin request rejected", http.StatusForbidden)
+		return
+	}
+	peer := p.Peer(r.FormValue("id"))
+	if peer == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	var (
+		events []*rfb.KeyEvent
+		what   []string
+	)
+	for _, combo := range r.Form["combo"] {
+		keysyms, err := parseCombo(combo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, pressEvents(keysyms...)...)
+		what = append(what, "combo "+combo)
+	}
+	if list := r.FormValue("keysyms"); list != "" {
+		keysyms, err := parseKeysyms(list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, pressEvents(keysyms...)...)
+		what = append(what, "keysyms "+list)
+	}
+	if text := r.FormValue("text"); text != "" {
+		events = append(events, typeEvents(text)...)
+		// the text may be a password, only its length is audited
+		what = append(what, fmt.Sprintf("text of %d characters", len([]rune(text))))
+	}
+	if len(events) == 0 {
+		http.Error(w, "nothing to inject", http.StatusBadRequest)
+		return
+	}
+
+	if err := peer.Inject(events, strings.Join(what, ", ")); err != nil {
+		log.Infof("inject into session %v failed: %v", peer.ID(), err)
+		http.Error(w, ErrBackendClosed.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID     string `json:"id"`
+		Events int    `json:"events"`
+	}{peer.ID(), len(events)})
+}
+
+// Peer returns the connected peer with the id, or nil
+func (p *Proxy) Peer(id string) *peer {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	for peer := range p.peers {
+		if peer.id == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// ID returns the session id of the peer, as reported in the audit events
+func (p *peer) ID() string {
+	return p.id
+}
+
+// Inject write key events to the backend on behalf of an admin and audit them as what
+func (p *peer) Inject(events []*rfb.KeyEvent, what string) error {
+	err := p.session.inject(events)
+	if err != nil {
+		what = fmt.Sprintf("%v failed: %v", what, err)
+	}
+	p.audit(&AuditEvent{Type: AuditInject, Text: what})
+	return err
+}
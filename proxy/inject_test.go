@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+func TestParseCombo(t *testing.T) {
+	tests := []struct {
+		combo   string
+		want    []uint32
+		wantErr bool
+	}{
+		{"ctrl+alt+del", []uint32{rfb.KeyControlL, rfb.KeyAltL, rfb.KeyDelete}, false},
+		{"Ctrl+Alt+F2", []uint32{rfb.KeyControlL, rfb.KeyAltL, rfb.KeyF2}, false},
+		{"control+shift+escape", []uint32{rfb.KeyControlL, rfb.KeyShiftL, rfb.KeyEscape}, false},
+		{"win+l", []uint32{rfb.KeySuperL, 'l'}, false},
+		{"ctrl+C", []uint32{rfb.KeyControlL, 'C'}, false},
+		{"alt+é", []uint32{rfb.KeyAltL, 0xe9}, false},
+		{"ctrl+€", []uint32{rfb.KeyControlL, 0x01000000 + '€'}, false},
+		{"space", []uint32{' '}, false},
+		{"enter", []uint32{rfb.KeyReturn}, false},
+		{"", nil, true},
+		{"ctrl+", nil, true},
+		{"ctrl++alt", nil, true},
+		{"+a", nil, true},
+		{"ctrl+foo", nil, true},
+		{"f13", nil, true},
+		{"ctrl alt del", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.combo, func(t *testing.T) {
+			got, err := parseCombo(tt.combo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCombo(%q) error = %v, want error %v", tt.combo, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseCombo(%q) = %#x, want %#x", tt.combo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeysyms(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []uint32
+		wantErr bool
+	}{
+		{"0xffe3,0x63", []uint32{0xffe3, 0x63}, false},
+		{"0xffe3, 99", []uint32{0xffe3, 99}, false},
+		{"0XFF0D", []uint32{0xff0d}, false},
+		{"0x01000100", []uint32{0x01000100}, false},
+		{"", nil, true},
+		{"0xffe3,", nil, true},
+		{"1,,2", nil, true},
+		{"ctrl", nil, true},
+		{"-1", nil, true},
+		{"0x100000000", nil, true},
+		{"0xffe3 0x63", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := parseKeysyms(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeysyms(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseKeysyms(%q) = %#x, want %#x", tt.list, got, tt.want)
+			}
+		})
+	}
+}
@@ -69,3 +69,16 @@ func getGID() uint64 {
 	n, _ := strconv.ParseUint(string(b), 10, 64)
 	return n
 }
+
+// currentTraceID returns the trace id added by AddTraceIdHook on the current goroutine
+func currentTraceID() string {
+	gid := getGID()
+	defer log.Unlock()
+	log.Lock()
+	for _, h := range log.StandardLogger().Hooks[log.InfoLevel] {
+		if t, ok := h.(*TraceIdHook); ok && t.GID == gid {
+			return t.TraceId
+		}
+	}
+	return ""
+}
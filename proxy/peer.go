@@ -4,70 +4,348 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/lwydyby/go-vnc-proxy/rfb"
 	"golang.org/x/net/websocket"
 )
 
 // peer represents a vnc proxy peer
-// with a websocket connection and a vnc backend connection
+// with a websocket connection viewing the session of a vnc backend connection
 type peer struct {
-	source *websocket.Conn
-	target net.Conn
+	// id identifies the peer in the audit events
+	id      string
+	source  *websocket.Conn
+	t       *Target
+	session *session
+	// queue holds the server messages not yet written to the websocket
+	queue chan []byte
+	// done is closed when the peer is stopped
+	done chan struct{}
+	// filters are the clipboard filters of the config and of the target
+	filters []ClipboardFilter
+	// auditSink receives the audit events of the peer, traceID is the trace id of its websocket request
+	auditSink AuditSink
+	traceID   string
+	// typed is the text typed since the last typed text audit event
+	typed typedText
+	// encodings are the encodings the peer of a shared session supports, nil while they are unknown.
+	// They are guarded by the lock of the session.
+	encodings []int32
+
+	l       sync.Mutex
+	reason  error
+	stopped bool
+	// lastInput is the time of the last input message of the client
+	lastInput time.Time
+}
+
+// peerQueueLength is the number of server messages queued for a peer
+const peerQueueLength = 64
+
+func newPeer(ws *websocket.Conn, t *Target, s *session, conf *Config) *peer {
+	p := &peer{
+		id:        newSessionID(),
+		source:    ws,
+		t:         t,
+		session:   s,
+		queue:     make(chan []byte, peerQueueLength),
+		done:      make(chan struct{}),
+		auditSink: LogAuditSink{},
+		traceID:   currentTraceID(),
+		lastInput: time.Now(),
+	}
+	if conf != nil {
+		p.filters = append(p.filters, conf.ClipboardFilters...)
+		if conf.AuditSink != nil {
+			p.auditSink = conf.AuditSink
+		}
+	}
+	p.filters = append(p.filters, t.ClipboardFilters...)
+	return p
+}
+
+// NewPeer dial the vnc backend of t and negotiate the handshake with ws,
+// the peer is the first one of a new session
+func NewPeer(ws *websocket.Conn, t *Target, conf *Config) (*peer, error) {
+	return openSession(newSession(t, ""), ws, conf)
 }
 
-func NewPeer(ws *websocket.Conn, addr string) (*peer, error) {
+func openSession(s *session, ws *websocket.Conn, conf *Config) (*peer, error) {
+	t := s.t
 	if ws == nil {
 		return nil, errors.New("websocket connection is nil")
 	}
-	var (
-		c   net.Conn
-		err error
-	)
-	c, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	if t == nil {
+		return nil, errors.New("vnc backend target is nil")
+	}
+	c, err := dialTarget(t, conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot connect to vnc backend")
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
 
-	err = c.(*net.TCPConn).SetKeepAlive(true)
+	// both legs must finish the handshake before the deadline
+	if conf != nil && conf.HandshakeTimeout > 0 {
+		deadline := time.Now().Add(conf.HandshakeTimeout)
+		ws.SetDeadline(deadline)
+		c.SetDeadline(deadline)
+	}
+	conn, clientAuth, err := negotiate(t, ws, c)
+	if err != nil {
+		return nil, err
+	}
+	// the peers joining later are not asked for the password the client answered
+	s.joinable = !clientAuth
+	serverInit, err := initialize(ws, conn, t.ReadOnly || t.Shared)
 	if err != nil {
-		return nil, errors.Wrap(err, "enable vnc backend connection keepalive failed")
+		return nil, err
 	}
+	ws.SetDeadline(time.Time{})
+	c.SetDeadline(time.Time{})
 
-	err = c.(*net.TCPConn).SetKeepAlivePeriod(30 * time.Second)
+	err = s.start(conn, serverInit)
 	if err != nil {
-		return nil, errors.Wrap(err, "set vnc backend connection keepalive period failed")
+		return nil, err
 	}
+	p := newPeer(ws, t, s, conf)
+	s.add(p)
+	go s.run()
+	return p, nil
+}
 
-	c, err = Connect(addr, ws, c)
+// dialTarget open the connection to the vnc backend of t with the Dialer of conf, optionally through an egress proxy,
+// or through its ssh host, or take the waiting connection of a server in reverse mode or connected to the repeater
+func dialTarget(t *Target, conf *Config) (net.Conn, error) {
+	if t.Reverse != "" {
+		if conf == nil || conf.ReverseListener == nil {
+			return nil, classify(ErrBackendUnreachable, errors.New("reverse connections are not enabled"))
+		}
+		c, ok := conf.ReverseListener.Take(t.Reverse)
+		if !ok {
+			return nil, classify(ErrBackendUnreachable, errors.Errorf("no vnc server connected as %q", t.Reverse))
+		}
+		return c, nil
+	}
+	if t.Repeater != "" {
+		if conf == nil || conf.Repeater == nil {
+			return nil, classify(ErrBackendUnreachable, errors.New("the repeater is not enabled"))
+		}
+		c, err := conf.Repeater.wait(t.Repeater)
+		if err != nil {
+			return nil, classify(ErrBackendUnreachable, err)
+		}
+		return c, nil
+	}
+	network := t.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if t.SSH != nil {
+		c, err := dialSSH(t.SSH, network, t.Addr)
+		if err != nil {
+			return nil, classify(ErrBackendUnreachable, err)
+		}
+		return c, nil
+	}
+	dialer := Dialer(defaultDialers)
+	egress := t.EgressProxy
+	if conf != nil {
+		if conf.Dialer != nil {
+			dialer = conf.Dialer
+		}
+		if egress == "" {
+			egress = conf.EgressProxy
+		}
+	}
+	if egress != "" && egress != EgressDirect {
+		d, err := NewEgressDialer(egress, dialer)
+		if err != nil {
+			return nil, classify(ErrBackendUnreachable, err)
+		}
+		dialer = d
+	}
+	c, err := dialer.Dial(network, t.Addr)
+	if err != nil {
+		return nil, classify(ErrBackendUnreachable, err)
+	}
+	return c, nil
+}
+
+// joinSession negotiate the handshake of ws with the proxy itself and add the peer to a running session
+func joinSession(s *session, ws *websocket.Conn, t *Target, conf *Config) (*peer, error) {
+	if conf != nil && conf.HandshakeTimeout > 0 {
+		ws.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	_, err := acceptHandshake(ws, s.currentServerInit())
 	if err != nil {
 		return nil, err
 	}
+	ws.SetDeadline(time.Time{})
+	p := newPeer(ws, t, s, conf)
+	if !s.join(p) {
+		return nil, ErrBackendClosed
+	}
+	return p, nil
+}
 
-	return &peer{
-		source: ws,
-		target: c,
-	}, nil
+// initialize relay ClientInit to the backend and ServerInit back to the client.
+// With shared set the shared-flag is forced, so that the client cannot make the backend
+// disconnect its other clients, e.g. from a view-only or a shared session.
+func initialize(source, target net.Conn, shared bool) (*rfb.ServerInit, error) {
+	clientInit, err := recv(source, 1, "ClientInit")
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		clientInit[0] = 1
+	}
+	_, err = target.Write(clientInit)
+	if err != nil {
+		return nil, err
+	}
+	serverInit, err := rfb.ReadServerInit(target)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &ProtocolError{Msg: "ServerInit", Err: err}
+	}
+	_, err = source.Write(serverInit.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return serverInit, nil
 }
 
-// ReadSource copy source stream to target connection
+// ReadSource relay the client messages to the session one by one,
+// which drops the input the peer may not send
 func (p *peer) ReadSource() error {
-	if _, err := io.Copy(p.target, p.source); err != nil {
-		return errors.Wrapf(err, "copy source(%v) => target(%v) failed", p.source.RemoteAddr(), p.target.RemoteAddr())
+	// the text typed after the last line is audited when the client leaves
+	defer p.flushTyped()
+	r := rfb.NewClientReader(p.source)
+	// oversized cut text is skipped without buffering it
+	r.MaxCutText = p.maxCutText(true)
+	for {
+		msg, err := r.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if isParseError(err) {
+				p.closeWith(&ProtocolError{Msg: "client message", Err: err})
+			}
+			return errors.Wrapf(err, "read source(%v) message failed", p.source.RemoteAddr())
+		}
+		if isInput(msg) {
+			p.touch()
+		}
+		if err = p.session.forward(p, msg); err != nil {
+			return errors.Wrapf(err, "write source(%v) message => target(%v) failed", p.source.RemoteAddr(), p.session.target.RemoteAddr())
+		}
+	}
+}
+
+// isInput reports whether msg changes the state of the remote desktop
+func isInput(msg rfb.Message) bool {
+	switch msg.Type() {
+	case rfb.KeyEventMsg, rfb.PointerEventMsg, rfb.ClientCutTextMsg,
+		rfb.SetDesktopSizeMsg, rfb.ClientXvpMsg, rfb.GiiMsg:
+		return true
+	case rfb.QEMUClientMsg:
+		_, ok := msg.(*rfb.QEMUExtendedKeyEvent)
+		return ok
 	}
-	return nil
+	return false
+}
+
+// isParseError reports whether err means the stream could not be framed,
+// as opposed to the connection being closed
+func isParseError(err error) bool {
+	_, ok := err.(*rfb.UnsupportedError)
+	return ok || err == rfb.ErrTooLarge
 }
 
-// ReadTarget copys target stream to source connection
+// ReadTarget write the server messages queued for the peer to the source connection until the peer is stopped
 func (p *peer) ReadTarget() error {
-	if _, err := io.Copy(p.source, p.target); err != nil {
-		return errors.Wrapf(err, "copy target(%v) => source(%v) failed", p.target.RemoteAddr(), p.source.RemoteAddr())
+	for {
+		select {
+		case data := <-p.queue:
+			if _, err := p.source.Write(data); err != nil {
+				return errors.Wrapf(err, "write target(%v) message => source(%v) failed", p.session.target.RemoteAddr(), p.source.RemoteAddr())
+			}
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// send queue a server message for the peer. A peer of a shared session
+// which does not keep up for slowPeerTimeout is disconnected.
+func (p *peer) send(data []byte, shared bool) {
+	select {
+	case p.queue <- data:
+		return
+	case <-p.done:
+		return
+	default:
+	}
+	var timeout <-chan time.Time
+	if shared {
+		timer := time.NewTimer(slowPeerTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.queue <- data:
+	case <-p.done:
+	case <-timeout:
+		p.closeWith(ErrPeerTooSlow)
+	}
+}
+
+// Kick disconnect the peer on behalf of an admin
+func (p *peer) Kick() {
+	p.closeWith(ErrKicked)
+}
+
+// closeWith stop the peer for reason, which is reported to the client once ReadTarget returns
+func (p *peer) closeWith(reason error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	p.reason = reason
+	close(p.done)
+}
+
+// closeReason returns why the peer stopped, nil when the client left
+func (p *peer) closeReason() error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.reason
+}
+
+// closeSource tell the client why the peer stopped and close the websocket connection.
+// ReadTarget is the only writer of the websocket, so it must only be called after ReadTarget returned.
+func (p *peer) closeSource(err error) {
+	reason := p.closeReason()
+	if reason == nil {
+		reason = err
 	}
-	return nil
+	closeWS(p.source, reason)
 }
 
-// Close close the websocket connection and the vnc backend connection
+// Close close the websocket connection and leave the session,
+// the vnc backend connection is closed with the last peer of the session
 func (p *peer) Close() {
 	p.source.Close()
-	p.target.Close()
+	p.session.remove(p)
 }
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+func TestInitialize(t *testing.T) {
+	serverInit := &rfb.ServerInit{Width: 64, Height: 48, PixelFormat: testPixelFormat, Name: "test"}
+	tests := []struct {
+		name       string
+		clientInit byte
+		shared     bool
+		want       byte
+	}{
+		{"exclusive", 0, false, 0},
+		{"shared by the client", 1, false, 1},
+		{"shared forced", 0, true, 1},
+		{"shared by the client and forced", 1, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, backend := scripted(reads(tt.want), step{send: serverInit.Bytes()})
+			source, client := scripted(writes(tt.clientInit), step{expect: serverInit.Bytes()})
+			got, err := initialize(source, target, tt.shared)
+			if err != nil {
+				t.Fatalf("initialize() error = %v", err)
+			}
+			if *got != *serverInit {
+				t.Fatalf("initialize() = %+v, want %+v", got, serverInit)
+			}
+			if err = <-backend; err != nil {
+				t.Fatalf("backend: %v", err)
+			}
+			if err = <-client; err != nil {
+				t.Fatalf("client: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadOnlyInput(t *testing.T) {
+	input := []rfb.Message{
+		&rfb.KeyEvent{Down: true, Key: 'a'},
+		&rfb.PointerEvent{ButtonMask: 1, X: 10, Y: 10},
+		&rfb.ClientCutText{Text: []byte("hello")},
+	}
+	tests := []struct {
+		name     string
+		readOnly bool
+		// want is the type of the first message the backend receives
+		want uint8
+	}{
+		{"read-only", true, rfb.FramebufferUpdateRequestMsg},
+		{"not read-only", false, rfb.KeyEventMsg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startBackend(t, false)
+			defer backend.close()
+			_, url, stop := serveWS(t, &Config{TokenHandler: func(r *http.Request) (*Target, error) {
+				return &Target{Addr: backend.addr(), ReadOnly: tt.readOnly}, nil
+			}})
+			defer stop()
+
+			c := connectWS(t, url)
+			defer c.Close()
+			conn := backend.conn(t)
+			if conn.shared != tt.readOnly {
+				t.Fatalf("shared-flag = %v, want %v", conn.shared, tt.readOnly)
+			}
+			for _, msg := range input {
+				c.write(t, msg.Bytes())
+			}
+			// not input, it is forwarded in any case
+			c.write(t, (&rfb.FramebufferUpdateRequest{Width: 64, Height: 48}).Bytes())
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			msg, err := rfb.NewClientReader(conn).ReadMessage()
+			if err != nil {
+				t.Fatalf("read the first client message: %v", err)
+			}
+			if msg.Type() != tt.want {
+				t.Fatalf("the backend received message type %d first, want %d", msg.Type(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// PlaybackHandler resolves the recording file a playback request replays,
+// it is called for the playback websocket and for every control request
+type PlaybackHandler func(r *http.Request) (path string, err error)
+
+var ErrSeekBackward = errors.New("cannot seek backward in a running playback, reconnect with the seek parameter instead")
+
+// ServePlayback replays the recording resolved by the PlaybackHandler to a websocket client,
+// e.g. noVNC, with its original timing. The query parameters set the initial state:
+// speed is the speed multiplier (default 1), seek the position to start at (e.g. 90s)
+// and paused=true starts the playback paused. With the id parameter the playback
+// can be controlled by ServePlaybackControl.
+func (p *Proxy) ServePlayback(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	r := ws.Request()
+	log.Debugf("playback request url: %v", r.URL)
+
+	if p.conf.PlaybackHandler == nil {
+		closeWS(ws, classify(ErrTokenRejected, errors.New("playback is not enabled")))
+		return
+	}
+	path, err := p.conf.PlaybackHandler(r)
+	if err != nil {
+		log.Infof("get recording failed: %v", err)
+		closeWS(ws, classify(ErrTokenRejected, err))
+		return
+	}
+	pl, err := newPlayer(path, r.URL.Query())
+	if err != nil {
+		log.Infof("playback of %v rejected: %v", path, err)
+		closeWS(ws, classify(ErrInvalidPlayback, err))
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Infof("open recording failed: %v", err)
+		closeWS(ws, err)
+		return
+	}
+	defer f.Close()
+	fr, err := newFBSReader(f)
+	if err != nil {
+		log.Infof("read recording %v failed: %v", path, err)
+		closeWS(ws, err)
+		return
+	}
+	serverInit, err := readRecordingInit(fr)
+	if err != nil {
+		log.Infof("read recording %v failed: %v", path, err)
+		closeWS(ws, err)
+		return
+	}
+
+	if p.conf.HandshakeTimeout > 0 {
+		ws.SetDeadline(time.Now().Add(p.conf.HandshakeTimeout))
+	}
+	if _, err = acceptHandshake(ws, serverInit); err != nil {
+		log.Infof("playback handshake failed: %v", err)
+		closeWS(ws, err)
+		return
+	}
+	ws.SetDeadline(time.Time{})
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		if !p.addPlayer(id, pl) {
+			log.Infof("playback %v is already running", id)
+			closeWS(ws, classify(ErrInvalidPlayback, errors.Errorf("playback %v is already running", id)))
+			return
+		}
+		defer p.deletePlayer(id)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// the recorded stream does not depend on the client, its messages are discarded
+		cr := rfb.NewClientReader(ws)
+		for {
+			if _, err := cr.ReadMessage(); err != nil {
+				break
+			}
+		}
+		close(done)
+	}()
+	err = pl.play(ws, fr, done)
+	if err != nil {
+		log.Infof("playback of %v failed: %v", path, err)
+	}
+	closeWS(ws, err)
+}
+
+// ServePlaybackControl changes a running playback. The query parameter id names the playback,
+// action is pause, resume, speed or seek, and value is the speed multiplier or the position to seek to.
+// The request must be authorized by the PlaybackHandler for the recording being played.
+// It responds with the state of the playback as JSON.
+func (p *Proxy) ServePlaybackControl(w http.ResponseWriter, r *http.Request) {
+	if p.conf.PlaybackHandler == nil {
+		http.Error(w, "playback is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	pl := p.Player(q.Get("id"))
+	if pl == nil {
+		http.Error(w, "playback not found", http.StatusNotFound)
+		return
+	}
+	path, err := p.conf.PlaybackHandler(r)
+	if err != nil || path != pl.path {
+		http.Error(w, "playback control rejected", http.StatusForbidden)
+		return
+	}
+	switch q.Get("action") {
+	case "pause":
+		pl.Pause()
+	case "resume":
+		pl.Resume()
+	case "speed":
+		var speed float64
+		speed, err = strconv.ParseFloat(q.Get("value"), 64)
+		if err == nil {
+			err = pl.SetSpeed(speed)
+		}
+	case "seek":
+		var position time.Duration
+		position, err = parsePosition(q.Get("value"))
+		if err == nil {
+			err = pl.Seek(position)
+		}
+	case "":
+	default:
+		err = errors.Errorf("unknown action %q", q.Get("action"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Position float64 `json:"position"`
+		Speed    float64 `json:"speed"`
+		Paused   bool    `json:"paused"`
+	}{pl.Position().Seconds(), pl.Speed(), pl.Paused()})
+}
+
+// Player returns the running playback with the id, or nil
+func (p *Proxy) Player(id string) *Player {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.players[id]
+}
+
+func (p *Proxy) addPlayer(id string, pl *Player) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if _, ok := p.players[id]; ok {
+		return false
+	}
+	p.players[id] = pl
+	return true
+}
+
+func (p *Proxy) deletePlayer(id string) {
+	p.l.Lock()
+	delete(p.players, id)
+	p.l.Unlock()
+}
+
+// Player replays a recording, its position advances with the speed multiplier while it is not paused
+type Player struct {
+	path string
+
+	l sync.Mutex
+	// pos is the position at mark
+	pos     time.Duration
+	mark    time.Time
+	speed   float64
+	paused  bool
+	changed chan struct{}
+}
+
+func newPlayer(path string, q url.Values) (*Player, error) {
+	pl := &Player{path: path, speed: 1, mark: time.Now(), changed: make(chan struct{}, 1)}
+	var err error
+	if v := q.Get("speed"); v != "" {
+		pl.speed, err = strconv.ParseFloat(v, 64)
+		if err != nil || pl.speed <= 0 {
+			return nil, errors.Errorf("invalid speed %q", v)
+		}
+	}
+	if v := q.Get("seek"); v != "" {
+		pl.pos, err = parsePosition(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pl.paused = q.Get("paused") == "true"
+	return pl, nil
+}
+
+// parsePosition parses a position given as duration (90s, 1m30s) or as seconds
+func parsePosition(v string) (time.Duration, error) {
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.Errorf("invalid position %q", v)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Position returns the time in the recording the playback is at
+func (pl *Player) Position() time.Duration {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	return pl.position()
+}
+
+func (pl *Player) position() time.Duration {
+	if pl.paused {
+		return pl.pos
+	}
+	return pl.pos + time.Duration(float64(time.Since(pl.mark))*pl.speed)
+}
+
+func (pl *Player) Speed() float64 {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	return pl.speed
+}
+
+func (pl *Player) Paused() bool {
+	pl.l.Lock()
+	defer pl.l.Unlock()
+	return pl.paused
+}
+
+func (pl *Player) Pause() {
+	pl.update(func() error {
+		pl.paused = true
+		return nil
+	})
+}
+
+func (pl *Player) Resume() {
+	pl.update(func() error {
+		pl.paused = false
+		return nil
+	})
+}
+
+// SetSpeed sets the speed multiplier, 2 plays twice as fast
+func (pl *Player) SetSpeed(speed float64) error {
+	return pl.update(func() error {
+		if speed <= 0 {
+			return errors.Errorf("invalid speed %v", speed)
+		}
+		pl.speed = speed
+		return nil
+	})
+}
+
+// Seek moves the playback forward to position, the updates up to it are sent at once.
+// The client holds the state of the framebuffer and of the encoders,
+// so seeking backward needs a new playback started with the seek parameter.
+func (pl *Player) Seek(position time.Duration) error {
+	return pl.update(func() error {
+		if position < pl.pos {
+			return ErrSeekBackward
+		}
+		pl.pos = position
+		return nil
+	})
+}
+
+// update applies f at the current position and wakes the playback up
+func (pl *Player) update(f func() error) error {
+	pl.l.Lock()
+	pl.pos = pl.position()
+	pl.mark = time.Now()
+	err := f()
+	pl.l.Unlock()
+	select {
+	case pl.changed <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// play writes the blocks of the recording to w when the playback reaches their timestamp,
+// until the recording ends or done is closed
+func (pl *Player) play(w io.Writer, fr *fbsReader, done <-chan struct{}) error {
+	// the clock starts once the handshake is done
+	pl.update(func() error { return nil })
+	for {
+		data, ts, err := fr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !pl.wait(ts, done) {
+			return nil
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// wait blocks until the playback reaches ts, it returns false if done is closed first
+func (pl *Player) wait(ts time.Duration, done <-chan struct{}) bool {
+	for {
+		pl.l.Lock()
+		remaining := ts - pl.position()
+		paused, speed := pl.paused, pl.speed
+		pl.l.Unlock()
+		if remaining <= 0 {
+			return true
+		}
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if !paused {
+			timer = time.NewTimer(time.Duration(float64(remaining) / speed))
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+		case <-pl.changed:
+		case <-done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-done:
+			return false
+		default:
+		}
+	}
+}
+
+// fbsReader reads the server to client stream of an FBS recording, see FBSHeader
+type fbsReader struct {
+	r *bufio.Reader
+	// cur is the unread rest of the current block
+	cur []byte
+	ts  time.Duration
+}
+
+func newFBSReader(r io.Reader) (*fbsReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(FBSHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != FBSHeader {
+		return nil, &ProtocolError{Msg: "FBS header", Err: ErrMalformed}
+	}
+	return &fbsReader{r: br}, nil
+}
+
+// next returns the rest of the current block or the next block with its timestamp.
+// A truncated last block, as left by a crashed proxy, ends the recording like io.EOF.
+func (fr *fbsReader) next() ([]byte, time.Duration, error) {
+	if len(fr.cur) > 0 {
+		data := fr.cur
+		fr.cur = nil
+		return data, fr.ts, nil
+	}
+	var length uint32
+	if err := binary.Read(fr.r, binary.BigEndian, &length); err != nil {
+		return nil, 0, endOfRecording(err)
+	}
+	if length > uint32(rfb.MaxPayloadLength) {
+		return nil, 0, &ProtocolError{Msg: "FBS block", Err: ErrMalformed}
+	}
+	padded := (length + 3) &^ 3
+	block := make([]byte, padded+4)
+	if _, err := io.ReadFull(fr.r, block); err != nil {
+		return nil, 0, endOfRecording(err)
+	}
+	fr.ts = time.Duration(binary.BigEndian.Uint32(block[padded:])) * time.Millisecond
+	return block[:length], fr.ts, nil
+}
+
+func (fr *fbsReader) Read(p []byte) (int, error) {
+	for len(fr.cur) == 0 {
+		data, _, err := fr.next()
+		if err != nil {
+			return 0, err
+		}
+		fr.cur = data
+	}
+	n := copy(p, fr.cur)
+	fr.cur = fr.cur[n:]
+	return n, nil
+}
+
+func endOfRecording(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// readRecordingInit reads the RFB 3.3 handshake at the start of a recording up to its ServerInit
+func readRecordingInit(r io.Reader) (*rfb.ServerInit, error) {
+	version := make([]byte, VERSION_LENGTH)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return nil, &ProtocolError{Msg: "ProtocolVersion", Err: err}
+	}
+	v, err := normalizeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if v != 3.3 {
+		return nil, &ProtocolError{Msg: "ProtocolVersion", Err: errors.Errorf("recordings of version %q are not supported", version)}
+	}
+	var authType uint32
+	if err = binary.Read(r, binary.BigEndian, &authType); err != nil {
+		return nil, &ProtocolError{Msg: "security type", Err: err}
+	}
+	switch int(authType) {
+	case NONE:
+	case VNC:
+		// only the server side is recorded: the challenge and the SecurityResult
+		if _, err = io.ReadFull(r, make([]byte, CHALLENGE_LENGTH+4)); err != nil {
+			return nil, &ProtocolError{Msg: "VNC Authentication challenge", Err: err}
+		}
+	default:
+		return nil, &ProtocolError{Msg: "security type", Err: errors.Errorf("security type %v is not supported in recordings", authType)}
+	}
+	serverInit, err := rfb.ReadServerInit(r)
+	if err != nil {
+		return nil, &ProtocolError{Msg: "ServerInit", Err: err}
+	}
+	return serverInit, nil
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	"golang.org/x/net/websocket"
+)
+
+// servePlayback serves ServePlayback of a proxy replaying path on a test http server
+func servePlayback(t *testing.T, path string) (string, func()) {
+	p := New(&Config{PlaybackHandler: func(r *http.Request) (string, error) {
+		return path, nil
+	}})
+	s := httptest.NewServer(websocket.Handler(p.ServePlayback))
+	return "ws" + strings.TrimPrefix(s.URL, "http"), s.Close
+}
+
+func TestPlayback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.fbs")
+	serverInit := recordTestSession(t, path, false)
+	blocks := readFBS(t, path)
+	last := blocks[len(blocks)-1].ts
+	stream := bytes.Join(testUpdates, nil)
+
+	tests := []struct {
+		name  string
+		query string
+		speed float64
+		seek  time.Duration
+	}{
+		{"original speed", "", 1, 0},
+		{"twice as fast", "?speed=2", 2, 0},
+		{"seek", "?seek=" + recordingDelay.String(), 1, recordingDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, stop := servePlayback(t, path)
+			defer stop()
+
+			c := dialWS(t, url+tt.query)
+			defer c.Close()
+			if types := c.startHandshake(t); !bytes.Equal(types, []byte{byte(NONE)}) {
+				t.Fatalf("security types = %v, want None", types)
+			}
+			c.acceptNone(t)
+			// the ServerInit of the recording
+			if got := c.initialize(t, false); *got != *serverInit {
+				t.Fatalf("ServerInit = %+v, want %+v", got, serverInit)
+			}
+			start := time.Now()
+			if got := c.read(t, len(stream)); !bytes.Equal(got, stream) {
+				t.Fatalf("the client received %x, want the recorded updates %x", got, stream)
+			}
+			d := time.Since(start)
+			if want := time.Duration(float64(last-tt.seek) / tt.speed); d < want-10*time.Millisecond || d > want+recordingDelay {
+				t.Fatalf("the playback took %v, want about %v", d, want)
+			}
+			if code := c.closeCode(t); code != CloseNormal {
+				t.Fatalf("close code = %d, want %d at the end of the recording", code, CloseNormal)
+			}
+		})
+	}
+}
+
+// testHandshake is the server side of a recorded RFB 3.3 handshake with the security bytes
+func testHandshake(security ...byte) []byte {
+	serverInit := &rfb.ServerInit{Width: 64, Height: 48, PixelFormat: testPixelFormat, Name: "test"}
+	return append(append([]byte("RFB 003.003\n"), security...), serverInit.Bytes()...)
+}
+
+// fbs returns an FBS file of the blocks
+func fbs(blocks ...[]byte) []byte {
+	f := []byte(FBSHeader)
+	for i, data := range blocks {
+		padded := (len(data) + 3) &^ 3
+		f = append(f, u32(uint32(len(data)))...)
+		f = append(f, data...)
+		f = append(f, make([]byte, padded-len(data))...)
+		f = append(f, u32(uint32(i*10))...)
+	}
+	return f
+}
+
+func TestFBSReader(t *testing.T) {
+	valid := fbs([]byte{1, 2, 3, 4, 5}, []byte{6})
+	tests := []struct {
+		name string
+		file []byte
+		// want are the blocks read before the recording ends
+		want [][]byte
+		// wantErr is the ProtocolError.Msg of an invalid file
+		wantErr string
+	}{
+		{"valid", valid, [][]byte{{1, 2, 3, 4, 5}, {6}}, ""},
+		{"no blocks", []byte(FBSHeader), nil, ""},
+		// the last block of a crashed proxy
+		{"truncated length", valid[:len(valid)-10], [][]byte{{1, 2, 3, 4, 5}}, ""},
+		{"truncated data", valid[:len(valid)-6], [][]byte{{1, 2, 3, 4, 5}}, ""},
+		{"truncated timestamp", valid[:len(valid)-1], [][]byte{{1, 2, 3, 4, 5}}, ""},
+		{"empty", nil, nil, "FBS header"},
+		{"truncated header", []byte(FBSHeader[:5]), nil, "FBS header"},
+		{"bad header", append([]byte("FBS 002.000\n"), valid[len(FBSHeader):]...), nil, "FBS header"},
+		{"not an FBS file", []byte("RFB 003.008\n"), nil, "FBS header"},
+		{"block too long", append([]byte(FBSHeader), 0xff, 0xff, 0xff, 0xff), nil, "FBS block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]byte
+			fr, err := newFBSReader(bytes.NewReader(tt.file))
+			for err == nil {
+				var data []byte
+				data, _, err = fr.next()
+				if err == nil {
+					got = append(got, data)
+				}
+			}
+			if tt.wantErr == "" {
+				if err != io.EOF {
+					t.Fatalf("next() error = %v, want io.EOF", err)
+				}
+			} else {
+				var pe *ProtocolError
+				if !errors.As(err, &pe) || pe.Msg != tt.wantErr {
+					t.Fatalf("error = %v, want a ProtocolError of the %v", err, tt.wantErr)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("read %d blocks, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Fatalf("block %d = %x, want %x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadRecordingInit(t *testing.T) {
+	none := testHandshake(0, 0, 0, byte(NONE))
+	tests := []struct {
+		name      string
+		recording []byte
+		// wantErr is the ProtocolError.Msg of an invalid recording
+		wantErr string
+	}{
+		{"none", none, ""},
+		{"vnc authentication", testHandshake(append(append([]byte{0, 0, 0, byte(VNC)}, testChallenge...), 0, 0, 0, 0)...), ""},
+		{"empty", nil, "ProtocolVersion"},
+		{"not a version", append([]byte("FBS 001.000\n"), none[VERSION_LENGTH:]...), "ProtocolVersion"},
+		{"version 3.8", append([]byte("RFB 003.008\n"), none[VERSION_LENGTH:]...), "ProtocolVersion"},
+		{"truncated security type", none[:VERSION_LENGTH+2], "security type"},
+		{"invalid security type", testHandshake(0, 0, 0, 0), "security type"},
+		{"vencrypt", testHandshake(0, 0, 0, byte(VENCRYPT)), "security type"},
+		{"truncated challenge", testHandshake(append([]byte{0, 0, 0, byte(VNC)}, testChallenge[:8]...)...)[:VERSION_LENGTH+4+8], "VNC Authentication challenge"},
+		{"truncated ServerInit", none[:len(none)-2], "ServerInit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverInit, err := readRecordingInit(bytes.NewReader(tt.recording))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("readRecordingInit() error = %v", err)
+				}
+				if serverInit.Name != "test" || serverInit.PixelFormat != testPixelFormat {
+					t.Fatalf("readRecordingInit() = %+v, want the recorded ServerInit", serverInit)
+				}
+				return
+			}
+			var pe *ProtocolError
+			if !errors.As(err, &pe) || pe.Msg != tt.wantErr {
+				t.Fatalf("readRecordingInit() error = %v, want a ProtocolError of the %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlaybackRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := filepath.Join(dir, "valid.fbs")
+	recordTestSession(t, valid, false)
+
+	tests := []struct {
+		name  string
+		file  []byte
+		query string
+		want  int
+	}{
+		{"bad header", []byte("FBS 002.000\n"), "", CloseProtocolError},
+		{"no handshake", fbs(), "", CloseProtocolError},
+		{"version 3.8", fbs(append([]byte("RFB 003.008\n"), testHandshake(0, 0, 0, byte(NONE))[VERSION_LENGTH:]...)), "", CloseProtocolError},
+		{"truncated ServerInit", fbs(testHandshake(0, 0, 0, byte(NONE))[:30]), "", CloseProtocolError},
+		{"invalid speed", nil, "?speed=0", CloseInvalidPlayback},
+		{"invalid seek", nil, "?seek=-1s", CloseInvalidPlayback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := valid
+			if tt.file != nil {
+				path = filepath.Join(dir, "invalid.fbs")
+				if err := ioutil.WriteFile(path, tt.file, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			url, stop := servePlayback(t, path)
+			defer stop()
+
+			c := dialWS(t, url+tt.query)
+			defer c.Close()
+			// the file is checked before the handshake
+			if code := c.closeCode(t); code != tt.want {
+				t.Fatalf("close code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
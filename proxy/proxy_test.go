@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	"golang.org/x/net/websocket"
+)
+
+// testPixelFormat is the pixel format of the test backends
+var testPixelFormat = rfb.PixelFormat{BPP: 32, Depth: 24, TrueColour: true,
+	RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}
+
+// testBackend is a 3.8 vnc server, it asks for the VNC Authentication
+// of the password "password" when auth is set
+type testBackend struct {
+	l    net.Listener
+	auth bool
+	// conns receives the connections which finished the handshake
+	conns chan *backendConn
+
+	mu  sync.Mutex
+	all []net.Conn
+}
+
+// backendConn is a connection of the proxy to a test backend, positioned after ServerInit
+type backendConn struct {
+	net.Conn
+	// shared is the shared-flag of the ClientInit of the proxy
+	shared bool
+}
+
+func startBackend(t *testing.T, auth bool) *testBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{l: l, auth: auth, conns: make(chan *backendConn, 8)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.all = append(b.all, c)
+			b.mu.Unlock()
+			go b.handshake(c)
+		}
+	}()
+	return b
+}
+
+func (b *testBackend) addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *testBackend) handshake(c net.Conn) {
+	security := []step{writes(1, byte(NONE)), reads(byte(NONE)), step{send: u32(0)}}
+	if b.auth {
+		security = []step{writes(1, byte(VNC)), reads(byte(VNC)), step{send: testChallenge}}
+	}
+	err := runSteps(c, append([]step{writeString("RFB 003.008\n"), readString("RFB 003.008\n")}, security...))
+	if err != nil {
+		c.Close()
+		return
+	}
+	if b.auth {
+		response := make([]byte, len(testResponse))
+		if _, err = io.ReadFull(c, response); err != nil || !bytes.Equal(response, testResponse) {
+			c.Write(concat(u32(1), u32(uint32(len("wrong password"))), []byte("wrong password")))
+			c.Close()
+			return
+		}
+		c.Write(u32(0))
+	}
+	clientInit := make([]byte, 1)
+	if _, err = io.ReadFull(c, clientInit); err != nil {
+		c.Close()
+		return
+	}
+	serverInit := &rfb.ServerInit{Width: 64, Height: 48, PixelFormat: testPixelFormat, Name: "test"}
+	if _, err = c.Write(serverInit.Bytes()); err != nil {
+		c.Close()
+		return
+	}
+	b.conns <- &backendConn{Conn: c, shared: clientInit[0] != 0}
+}
+
+// conn returns the next connection of the proxy which finished the handshake
+func (b *testBackend) conn(t *testing.T) *backendConn {
+	t.Helper()
+	select {
+	case c := <-b.conns:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the proxy to connect to the backend")
+		return nil
+	}
+}
+
+// noConn fails if the proxy opened another connection to the backend
+func (b *testBackend) noConn(t *testing.T) {
+	t.Helper()
+	select {
+	case <-b.conns:
+		t.Fatal("the proxy opened another backend connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (b *testBackend) close() {
+	b.l.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.all {
+		c.Close()
+	}
+}
+
+// serveWS serves ServeWS of a proxy with conf on a test http server
+func serveWS(t *testing.T, conf *Config) (*Proxy, string, func()) {
+	p := New(conf)
+	s := httptest.NewServer(websocket.Handler(p.ServeWS))
+	return p, "ws" + strings.TrimPrefix(s.URL, "http"), s.Close
+}
+
+// wsClient is a websocket client of the proxy, it reads the binary messages as one stream
+type wsClient struct {
+	c *gws.Conn
+	r io.Reader
+}
+
+func dialWS(t *testing.T, url string) *wsClient {
+	c, _, err := gws.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return &wsClient{c: c}
+}
+
+func (c *wsClient) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsClient) Write(b []byte) (int, error) {
+	return len(b), c.c.WriteMessage(gws.BinaryMessage, b)
+}
+
+func (c *wsClient) Close() error {
+	return c.c.Close()
+}
+
+// closeCode discards the messages until the proxy closes the websocket and returns the close code
+func (c *wsClient) closeCode(t *testing.T) int {
+	t.Helper()
+	for {
+		if _, err := io.Copy(ioutil.Discard, c); err != nil {
+			if ce, ok := err.(*gws.CloseError); ok {
+				return ce.Code
+			}
+			t.Fatalf("read until the close frame: %v", err)
+		}
+	}
+}
+
+// read fails unless the next n bytes of the proxy arrive
+func (c *wsClient) read(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("read %d bytes from the proxy: %v", n, err)
+	}
+	return b
+}
+
+func (c *wsClient) write(t *testing.T, b []byte) {
+	t.Helper()
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startHandshake exchange the 3.8 ProtocolVersion and return the security types offered to the client
+func (c *wsClient) startHandshake(t *testing.T) []byte {
+	t.Helper()
+	if v := c.read(t, VERSION_LENGTH); string(v) != "RFB 003.008\n" {
+		t.Fatalf("ProtocolVersion = %q, want 3.8", v)
+	}
+	c.write(t, []byte("RFB 003.008\n"))
+	n := c.read(t, 1)
+	return c.read(t, int(n[0]))
+}
+
+// vncAuth choose VNC Authentication, answer the challenge with password and return the SecurityResult
+func (c *wsClient) vncAuth(t *testing.T, password string) uint32 {
+	t.Helper()
+	c.write(t, []byte{byte(VNC)})
+	response, err := encryptChallenge(password, c.read(t, CHALLENGE_LENGTH))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.write(t, response)
+	return binary.BigEndian.Uint32(c.read(t, 4))
+}
+
+// acceptNone choose security type None
+func (c *wsClient) acceptNone(t *testing.T) {
+	t.Helper()
+	c.write(t, []byte{byte(NONE)})
+	if result := binary.BigEndian.Uint32(c.read(t, 4)); result != 0 {
+		t.Fatalf("SecurityResult = %d, want 0", result)
+	}
+}
+
+// initialize send ClientInit and read ServerInit
+func (c *wsClient) initialize(t *testing.T, shared bool) *rfb.ServerInit {
+	t.Helper()
+	clientInit := []byte{0}
+	if shared {
+		clientInit[0] = 1
+	}
+	c.write(t, clientInit)
+	serverInit, err := rfb.ReadServerInit(c)
+	if err != nil {
+		t.Fatalf("read ServerInit: %v", err)
+	}
+	return serverInit
+}
+
+// connectWS open a session through the proxy, answering VNC Authentication with "password"
+func connectWS(t *testing.T, url string) *wsClient {
+	t.Helper()
+	c := dialWS(t, url)
+	types := c.startHandshake(t)
+	if types[0] == byte(VNC) {
+		if result := c.vncAuth(t, "password"); result != 0 {
+			t.Fatalf("SecurityResult = %d, want 0", result)
+		}
+	} else {
+		c.acceptNone(t)
+	}
+	c.initialize(t, false)
+	return c
+}
+
+func TestSharedSessionJoinAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		// types are the security types offered to the joining client
+		types []byte
+	}{
+		{"the proxy authenticated", "password", []byte{byte(NONE)}},
+		{"the first client authenticated", "", []byte{byte(VNC)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startBackend(t, true)
+			defer backend.close()
+			_, url, stop := serveWS(t, &Config{TokenHandler: func(r *http.Request) (*Target, error) {
+				return &Target{Addr: backend.addr(), Shared: true, Password: tt.password}, nil
+			}})
+			defer stop()
+
+			first := connectWS(t, url)
+			defer first.Close()
+			backend.conn(t)
+
+			joiner := dialWS(t, url)
+			defer joiner.Close()
+			if got := joiner.startHandshake(t); !bytes.Equal(got, tt.types) {
+				t.Fatalf("security types of the joining client = %v, want %v", got, tt.types)
+			}
+			if tt.password != "" {
+				joiner.acceptNone(t)
+				joiner.initialize(t, false)
+				backend.noConn(t)
+				return
+			}
+			if result := joiner.vncAuth(t, "wrong"); result == 0 {
+				t.Fatal("the joining client passed VNC Authentication with a wrong password")
+			}
+			if code := joiner.closeCode(t); code != CloseAuthFailed {
+				t.Fatalf("close code = %d, want %d", code, CloseAuthFailed)
+			}
+			// with the password the client gets its own backend connection
+			other := connectWS(t, url)
+			defer other.Close()
+			if c := backend.conn(t); !c.shared {
+				t.Fatal("the shared-flag of the other client was not forced")
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name string
+		// the backend never sends its ProtocolVersion, otherwise the client never answers it
+		stalledBackend bool
+	}{
+		{"stalled backend", true},
+		{"stalled client", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			stalledBackend := tt.stalledBackend
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					defer c.Close()
+					if !stalledBackend {
+						c.Write([]byte("RFB 003.008\n"))
+					}
+				}
+			}()
+			_, url, stop := serveWS(t, &Config{HandshakeTimeout: timeout, TokenHandler: func(r *http.Request) (*Target, error) {
+				return &Target{Addr: l.Addr().String()}, nil
+			}})
+			defer stop()
+
+			c := dialWS(t, url)
+			defer c.Close()
+			start := time.Now()
+			if code := c.closeCode(t); code != CloseProtocolError {
+				t.Fatalf("close code = %d, want %d", code, CloseProtocolError)
+			}
+			if d := time.Since(start); d < timeout/2 {
+				t.Fatalf("the handshake failed after %v, want about %v", d, timeout)
+			}
+		})
+	}
+}
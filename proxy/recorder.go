@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+	"github.com/pkg/errors"
+)
+
+// FBSHeader starts an FBS (RFB session) file, the format written by rfbproxy
+// and played back by rfbplayer and the proxy playback handler:
+//
+//	"FBS 001.000\n"
+//	followed by blocks of
+//	  uint32 length of the data, big endian
+//	  data, padded with zeros to a multiple of 4 bytes
+//	  uint32 milliseconds since the start of the recording, big endian
+//
+// The data of all blocks is the server to client stream of an RFB 3.3 session
+// with security type None, starting with its ProtocolVersion.
+const FBSHeader = "FBS 001.000\n"
+
+// InputSuffix is appended to the recording path to name the file
+// recording the client input, which has the FBS layout as well
+// but holds the client to server messages.
+const InputSuffix = ".input"
+
+// recorder writes the server to client stream of a session to an FBS file.
+// Every block is written with a single write, so the file stays usable when the proxy crashes.
+type recorder struct {
+	l      sync.Mutex
+	f      *os.File
+	input  *os.File
+	start  time.Time
+	header *rfb.ServerInit
+	// started is set once the handshake block is written
+	started bool
+}
+
+func newRecorder(path string, recordInput bool, serverInit *rfb.ServerInit) (*recorder, error) {
+	f, err := createFBS(path)
+	if err != nil {
+		return nil, err
+	}
+	header := *serverInit
+	r := &recorder{f: f, start: time.Now(), header: &header}
+	if recordInput {
+		r.input, err = createFBS(path + InputSuffix)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func createFBS(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "create recording failed")
+	}
+	if _, err = f.Write([]byte(FBSHeader)); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "write recording header failed")
+	}
+	return f, nil
+}
+
+// SetPixelFormat updates the pixel format announced by the recorded ServerInit,
+// the client usually sends SetPixelFormat before the server sends any update
+func (r *recorder) SetPixelFormat(pf rfb.PixelFormat) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.started {
+		if pf != r.header.PixelFormat {
+			log.Warnf("pixel format changed after the recording started, playback may be corrupted")
+		}
+		return
+	}
+	r.header.PixelFormat = pf
+}
+
+// Write records data sent by the server
+func (r *recorder) Write(data []byte) (int, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if !r.started {
+		r.started = true
+		// the handshake happened when the recording started
+		handshake := append([]byte("RFB 003.003\n"), 0, 0, 0, byte(NONE))
+		if err := r.writeBlock(r.f, append(handshake, r.header.Bytes()...), 0); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.writeBlock(r.f, data, r.elapsed()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// WriteInput records a message sent by the client, it does nothing unless client input is recorded
+func (r *recorder) WriteInput(msg []byte) error {
+	if r.input == nil {
+		return nil
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.writeBlock(r.input, msg, r.elapsed())
+}
+
+func (r *recorder) elapsed() uint32 {
+	return uint32(time.Since(r.start) / time.Millisecond)
+}
+
+func (r *recorder) writeBlock(f *os.File, data []byte, timestamp uint32) error {
+	padded := (len(data) + 3) &^ 3
+	block := make([]byte, 4+padded+4)
+	binary.BigEndian.PutUint32(block, uint32(len(data)))
+	copy(block[4:], data)
+	binary.BigEndian.PutUint32(block[4+padded:], timestamp)
+	if _, err := f.Write(block); err != nil {
+		return errors.Wrapf(err, "write recording %v failed", f.Name())
+	}
+	return nil
+}
+
+func (r *recorder) Close() {
+	r.f.Close()
+	if r.input != nil {
+		r.input.Close()
+	}
+}
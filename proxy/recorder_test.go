@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// recordingDelay is the time between the updates of recordTestSession
+const recordingDelay = 50 * time.Millisecond
+
+// testUpdates are the server messages recorded by recordTestSession,
+// the second one needs padding
+var testUpdates = [][]byte{
+	(&rfb.FramebufferUpdate{Rects: []rfb.Rectangle{{Width: 1, Height: 1, Encoding: rfb.EncodingRaw, Data: []byte{1, 2, 3, 4}}}}).Bytes(),
+	{rfb.BellMsg},
+	(&rfb.ServerCutText{Text: []byte("hello")}).Bytes(),
+}
+
+// testInput is the client message recorded by recordTestSession
+var testInput = (&rfb.KeyEvent{Down: true, Key: 'a'}).Bytes()
+
+// recordTestSession records testUpdates recordingDelay apart and testInput to path,
+// the client switches to pf8 before the first update. It returns the recorded ServerInit.
+func recordTestSession(t *testing.T, path string, recordInput bool) *rfb.ServerInit {
+	t.Helper()
+	serverInit := &rfb.ServerInit{Width: 64, Height: 48, PixelFormat: testPixelFormat, Name: "test"}
+	r, err := newRecorder(path, recordInput, serverInit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetPixelFormat(pf8)
+	for i, update := range testUpdates {
+		if i > 0 {
+			time.Sleep(recordingDelay)
+		}
+		if _, err = r.Write(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.WriteInput(testInput); err != nil {
+		t.Fatal(err)
+	}
+	recorded := *serverInit
+	recorded.PixelFormat = pf8
+	return &recorded
+}
+
+// fbsBlock is a block of an FBS file
+type fbsBlock struct {
+	data []byte
+	ts   time.Duration
+}
+
+// readFBS parses the FBS file at path, see FBSHeader
+func readFBS(t *testing.T, path string) []fbsBlock {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(FBSHeader)) {
+		t.Fatalf("the recording starts with %q, want %q", b[:len(FBSHeader)], FBSHeader)
+	}
+	b = b[len(FBSHeader):]
+	var blocks []fbsBlock
+	for len(b) > 0 {
+		if len(b) < 4 {
+			t.Fatalf("%d bytes left after block %d, want a block length", len(b), len(blocks))
+		}
+		length := int(binary.BigEndian.Uint32(b))
+		padded := (length + 3) &^ 3
+		if len(b) < 4+padded+4 {
+			t.Fatalf("block %d of %d bytes is truncated to %d bytes", len(blocks), length, len(b)-8)
+		}
+		if padding := b[4+length : 4+padded]; !bytes.Equal(padding, make([]byte, len(padding))) {
+			t.Fatalf("block %d is padded with %x, want zeros", len(blocks), padding)
+		}
+		ts := time.Duration(binary.BigEndian.Uint32(b[4+padded:])) * time.Millisecond
+		blocks = append(blocks, fbsBlock{data: b[4 : 4+length], ts: ts})
+		b = b[4+padded+4:]
+	}
+	return blocks
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.fbs")
+	serverInit := recordTestSession(t, path, true)
+
+	blocks := readFBS(t, path)
+	if len(blocks) != 1+len(testUpdates) {
+		t.Fatalf("the recording has %d blocks, want the handshake and %d updates", len(blocks), len(testUpdates))
+	}
+	// the handshake of an RFB 3.3 session without authentication, announcing the format set by the client
+	handshake := append([]byte("RFB 003.003\n"), 0, 0, 0, byte(NONE))
+	handshake = append(handshake, serverInit.Bytes()...)
+	if !bytes.Equal(blocks[0].data, handshake) || blocks[0].ts != 0 {
+		t.Fatalf("block 0 = %x at %v, want the handshake %x at 0", blocks[0].data, blocks[0].ts, handshake)
+	}
+	for i, update := range testUpdates {
+		block := blocks[1+i]
+		if !bytes.Equal(block.data, update) {
+			t.Fatalf("block %d = %x, want %x", 1+i, block.data, update)
+		}
+		// the timestamps are milliseconds since the recording started
+		if min, max := time.Duration(i)*recordingDelay, time.Duration(i+1)*recordingDelay; block.ts < min || block.ts > max {
+			t.Fatalf("block %d is at %v, want between %v and %v", 1+i, block.ts, min, max)
+		}
+	}
+
+	input := readFBS(t, path+InputSuffix)
+	if len(input) != 1 || !bytes.Equal(input[0].data, testInput) {
+		t.Fatalf("the input recording has %d blocks, want the key event %x", len(input), testInput)
+	}
+	if last := blocks[len(blocks)-1].ts; input[0].ts < last {
+		t.Fatalf("the input is at %v, want after the last update at %v", input[0].ts, last)
+	}
+}
+
+func TestRecorderWithoutInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.fbs")
+	recordTestSession(t, path, false)
+	if _, err = os.Stat(path + InputSuffix); !os.IsNotExist(err) {
+		t.Fatalf("stat the input recording: %v, want it not to exist", err)
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.fbs")
+	backend := startBackend(t, false)
+	defer backend.close()
+	_, url, stop := serveWS(t, &Config{TokenHandler: func(r *http.Request) (*Target, error) {
+		return &Target{Addr: backend.addr(), RecordPath: path, RecordInput: true}, nil
+	}})
+	defer stop()
+
+	c := connectWS(t, url)
+	defer c.Close()
+	conn := backend.conn(t)
+	c.write(t, testInput)
+	expectMessage(t, rfb.NewClientReader(conn), conn, &rfb.KeyEvent{Down: true, Key: 'a'})
+	if _, err = conn.Write([]byte{rfb.BellMsg}); err != nil {
+		t.Fatal(err)
+	}
+	// the update is recorded before it is sent to the client
+	c.read(t, 1)
+
+	blocks := readFBS(t, path)
+	serverInit := &rfb.ServerInit{Width: 64, Height: 48, PixelFormat: testPixelFormat, Name: "test"}
+	handshake := append([]byte("RFB 003.003\n"), 0, 0, 0, byte(NONE))
+	handshake = append(handshake, serverInit.Bytes()...)
+	if len(blocks) != 2 || !bytes.Equal(blocks[0].data, handshake) || !bytes.Equal(blocks[1].data, []byte{rfb.BellMsg}) {
+		t.Fatalf("the recording has the blocks %+v, want the handshake %x and the bell", blocks, handshake)
+	}
+	input := readFBS(t, path+InputSuffix)
+	if len(input) != 1 || !bytes.Equal(input[0].data, testInput) {
+		t.Fatalf("the input recording has the blocks %+v, want the key event %x", input, testInput)
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/lwydyby/logrus"
+	"github.com/pkg/errors"
+)
+
+// repeaterIDLength is the size of the ID:nnnn string viewers and servers send to an UltraVNC repeater,
+// padded with zero bytes
+const repeaterIDLength = 250
+
+// repeaterVersion is sent to the viewers, which answer with their ID
+var repeaterVersion = []byte("RFB 000.000\n")
+
+// Repeater is an UltraVNC repeater in mode II: vnc viewers and servers (e.g. SingleClick) connect to it
+// with the same ID:nnnn and are paired, the bytes between them are relayed unchanged.
+// A websocket client of a Target with Repeater set joins as the viewer of the server with that ID.
+// A viewer or server connecting again with its ID replaces its waiting connection.
+type Repeater struct {
+	// HandshakeTimeout limits the time a viewer or server takes to send its ID, defaults to 10 seconds
+	HandshakeTimeout time.Duration
+	// ViewerTimeout limits the time a websocket client waits for its server, defaults to 30 seconds
+	ViewerTimeout time.Duration
+	// WaitTimeout closes the connection of a viewer or server which was not paired in this time,
+	// defaults to an hour, 0 means no limit
+	WaitTimeout time.Duration
+
+	mu        sync.Mutex
+	servers   map[string]*reverseConn
+	viewers   map[string]*reverseConn
+	clients   map[string]chan net.Conn
+	listeners []net.Listener
+}
+
+func NewRepeater() *Repeater {
+	return &Repeater{
+		HandshakeTimeout: 10 * time.Second,
+		ViewerTimeout:    30 * time.Second,
+		WaitTimeout:      time.Hour,
+		servers:          make(map[string]*reverseConn),
+		viewers:          make(map[string]*reverseConn),
+		clients:          make(map[string]chan net.Conn),
+	}
+}
+
+// ServeViewers accept vnc viewers on l until it fails or is closed
+func (r *Repeater) ServeViewers(l net.Listener) error {
+	return r.serve(l, true)
+}
+
+// ServeServers accept vnc servers on l until it fails or is closed
+func (r *Repeater) ServeServers(l net.Listener) error {
+	return r.serve(l, false)
+}
+
+// Close stop accepting viewers and servers and close the waiting connections,
+// the paired connections are not closed
+func (r *Repeater) Close() error {
+	r.mu.Lock()
+	listeners := r.listeners
+	waiting := make([]*reverseConn, 0, len(r.servers)+len(r.viewers))
+	for _, conns := range []map[string]*reverseConn{r.servers, r.viewers} {
+		for id, rc := range conns {
+			waiting = append(waiting, rc)
+			delete(conns, id)
+		}
+	}
+	r.listeners = nil
+	r.mu.Unlock()
+	var err error
+	for _, l := range listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, rc := range waiting {
+		rc.Conn.Close()
+	}
+	return err
+}
+
+func (r *Repeater) serve(l net.Listener, viewer bool) error {
+	r.mu.Lock()
+	r.listeners = append(r.listeners, l)
+	r.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(c, viewer)
+	}
+}
+
+// handle pair c with the waiting connection of the other side, or keep it waiting
+func (r *Repeater) handle(c net.Conn, viewer bool) {
+	side := "server"
+	if viewer {
+		side = "viewer"
+	}
+	id, err := r.handshake(c, viewer)
+	if err != nil {
+		log.Infof("repeater %v %v failed: %v", side, c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	r.mu.Lock()
+	waiting, other := r.servers, r.viewers
+	if viewer {
+		waiting, other = r.viewers, r.servers
+	}
+	if ch, ok := r.clients[id]; ok && !viewer {
+		delete(r.clients, id)
+		// handed over under the lock, so that a client giving up meanwhile finds it,
+		// the buffered channel never blocks
+		ch <- c
+		r.mu.Unlock()
+		log.Infof("repeater server %v joined websocket client as %q", c.RemoteAddr(), id)
+		return
+	}
+	if rc, ok := other[id]; ok {
+		delete(other, id)
+		r.mu.Unlock()
+		log.Infof("repeater %v %v paired with %v as %q", side, c.RemoteAddr(), rc.RemoteAddr(), id)
+		relay(c, rc.take())
+		return
+	}
+	rc := newReverseConn(c, nil)
+	old := waiting[id]
+	waiting[id] = rc
+	r.mu.Unlock()
+	if old != nil {
+		old.Conn.Close()
+	}
+
+	log.Infof("repeater %v %v waiting as %q", side, c.RemoteAddr(), id)
+	err = rc.watch(r.WaitTimeout)
+	r.mu.Lock()
+	if waiting[id] == rc {
+		delete(waiting, id)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		log.Infof("repeater %v %v as %q disconnected: %v", side, c.RemoteAddr(), id, err)
+	}
+}
+
+// handshake returns the ID sent by a viewer or server
+func (r *Repeater) handshake(c net.Conn, viewer bool) (string, error) {
+	if r.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(r.HandshakeTimeout))
+	}
+	if viewer {
+		if _, err := c.Write(repeaterVersion); err != nil {
+			return "", err
+		}
+	}
+	b, err := recv(c, repeaterIDLength, "repeater ID")
+	if err != nil {
+		return "", err
+	}
+	c.SetDeadline(time.Time{})
+	return parseRepeaterID(b)
+}
+
+// parseRepeaterID returns nnnn of ID:nnnn, the host:port of mode I is not supported
+func parseRepeaterID(b []byte) (string, error) {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	s := string(b)
+	if !strings.HasPrefix(s, "ID:") || len(s) == len("ID:") {
+		return "", errors.Errorf("unsupported repeater id %q, only ID:nnnn is supported", s)
+	}
+	return s[len("ID:"):], nil
+}
+
+// wait returns the connection of the server with id for a websocket client,
+// waiting at most ViewerTimeout for the server to connect
+func (r *Repeater) wait(id string) (net.Conn, error) {
+	r.mu.Lock()
+	if rc, ok := r.servers[id]; ok {
+		delete(r.servers, id)
+		r.mu.Unlock()
+		return rc.take(), nil
+	}
+	ch := make(chan net.Conn, 1)
+	if old, ok := r.clients[id]; ok {
+		close(old)
+	}
+	r.clients[id] = ch
+	r.mu.Unlock()
+
+	timeout := r.ViewerTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c := <-ch:
+		if c == nil {
+			return nil, errors.Errorf("replaced by another client of repeater id %q", id)
+		}
+		return c, nil
+	case <-timer.C:
+	}
+	r.mu.Lock()
+	if r.clients[id] == ch {
+		delete(r.clients, id)
+	}
+	r.mu.Unlock()
+	// the server may have been handed over meanwhile
+	select {
+	case c := <-ch:
+		if c != nil {
+			return c, nil
+		}
+	default:
+	}
+	return nil, errors.Errorf("no vnc server connected to the repeater as %q within %v", id, timeout)
+}
+
+// relay copy the bytes between a and b until either side closes, then close both
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
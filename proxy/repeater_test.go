@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRepeaterID(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    string
+		wantErr bool
+	}{
+		{"padded", repeaterIDBytes("ID:1234"), "1234", false},
+		{"not padded", []byte("ID:abc"), "abc", false},
+		{"host and port of mode I", repeaterIDBytes("10.0.0.1:5900"), "", true},
+		{"empty id", repeaterIDBytes("ID:"), "", true},
+		{"zero bytes only", make([]byte, repeaterIDLength), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRepeaterID(tt.b)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("parseRepeaterID() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// repeaterIDBytes pads id as sent to a repeater
+func repeaterIDBytes(id string) []byte {
+	b := make([]byte, repeaterIDLength)
+	copy(b, id)
+	return b
+}
+
+func testRepeater(t *testing.T) (*Repeater, string, string) {
+	r := NewRepeater()
+	viewers, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ServeViewers(viewers)
+	go r.ServeServers(servers)
+	return r, viewers.Addr().String(), servers.Addr().String()
+}
+
+// dialRepeaterServer connects a vnc server with id, which sends its ProtocolVersion right away
+func dialRepeaterServer(t *testing.T, addr, id string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(repeaterIDBytes("ID:" + id))
+	c.Write([]byte("RFB 003.008\n"))
+	return c
+}
+
+// dialRepeaterViewer connects a vnc viewer with id after reading the version of the repeater
+func dialRepeaterViewer(t *testing.T, addr, id string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, c, string(repeaterVersion))
+	c.Write(repeaterIDBytes("ID:" + id))
+	return c
+}
+
+func expectRead(t *testing.T, c net.Conn, want string) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(c, b); err != nil || !bytes.Equal(b, []byte(want)) {
+		t.Fatalf("read %q, %v, want %q", b, err, want)
+	}
+	c.SetReadDeadline(time.Time{})
+}
+
+func TestRepeaterPairing(t *testing.T) {
+	for _, serverFirst := range []bool{true, false} {
+		name := "viewer first"
+		if serverFirst {
+			name = "server first"
+		}
+		t.Run(name, func(t *testing.T) {
+			r, viewers, servers := testRepeater(t)
+			defer r.Close()
+
+			var server, viewer net.Conn
+			if serverFirst {
+				server = dialRepeaterServer(t, servers, "1234")
+				eventually(t, "the server to wait", func() bool { return waitingServer(r, "1234") })
+				viewer = dialRepeaterViewer(t, viewers, "1234")
+			} else {
+				viewer = dialRepeaterViewer(t, viewers, "1234")
+				server = dialRepeaterServer(t, servers, "1234")
+			}
+			defer server.Close()
+			defer viewer.Close()
+
+			// what the server sent while waiting is relayed
+			expectRead(t, viewer, "RFB 003.008\n")
+			viewer.Write([]byte("RFB 003.008\n"))
+			expectRead(t, server, "RFB 003.008\n")
+
+			// closing one side closes the other
+			viewer.Close()
+			expectClosed(t, server)
+		})
+	}
+}
+
+func waitingServer(r *Repeater, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.servers[id]
+	return ok
+}
+
+func TestRepeaterDifferentIDs(t *testing.T) {
+	r, viewers, servers := testRepeater(t)
+	defer r.Close()
+
+	server := dialRepeaterServer(t, servers, "1")
+	defer server.Close()
+	viewer := dialRepeaterViewer(t, viewers, "2")
+	defer viewer.Close()
+	eventually(t, "the server to wait", func() bool { return waitingServer(r, "1") })
+	viewer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := viewer.Read(make([]byte, 1)); n != 0 || !isTimeout(err) {
+		t.Fatalf("the viewer of another id read %d bytes, %v", n, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestRepeaterWait(t *testing.T) {
+	tests := []struct {
+		name string
+		// serverFirst connects the server before the websocket client waits
+		serverFirst bool
+	}{
+		{"server waiting", true},
+		{"server connecting later", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, servers := testRepeater(t)
+			defer r.Close()
+
+			server := make(chan net.Conn, 1)
+			if tt.serverFirst {
+				server <- dialRepeaterServer(t, servers, "42")
+				eventually(t, "the server to wait", func() bool { return waitingServer(r, "42") })
+			} else {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					server <- dialRepeaterServer(t, servers, "42")
+				}()
+			}
+			c, err := r.wait("42")
+			if err != nil {
+				t.Fatalf("wait() error = %v", err)
+			}
+			defer c.Close()
+			defer (<-server).Close()
+			expectRead(t, c, "RFB 003.008\n")
+		})
+	}
+}
+
+func TestRepeaterWaitTimeout(t *testing.T) {
+	r := NewRepeater()
+	r.ViewerTimeout = 20 * time.Millisecond
+	if _, err := r.wait("42"); err == nil {
+		t.Fatal("wait() without a server succeeded")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.clients) != 0 {
+		t.Fatalf("wait() left %d clients waiting", len(r.clients))
+	}
+}
+
+// a server connecting while the client gives up is either handed over or kept waiting, never lost
+func TestRepeaterWaitTimeoutRace(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		r := NewRepeater()
+		r.ViewerTimeout = time.Millisecond
+		server, c := net.Pipe()
+		go r.handle(c, false)
+		go func(delay time.Duration) {
+			// around the timeout of the client
+			time.Sleep(delay)
+			server.Write(repeaterIDBytes("ID:42"))
+		}(time.Duration(i%20) * 100 * time.Microsecond)
+		if c, err := r.wait("42"); err == nil {
+			c.Close()
+		} else {
+			eventually(t, "the server to wait", func() bool { return waitingServer(r, "42") })
+		}
+		r.Close()
+		server.Close()
+	}
+}
+
+func TestRepeaterWaitReplaced(t *testing.T) {
+	r := NewRepeater()
+	r.ViewerTimeout = 100 * time.Millisecond
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.wait("42")
+		errs <- err
+	}()
+	eventually(t, "the client to wait", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.clients["42"] != nil
+	})
+	go r.wait("42")
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "replaced") {
+			t.Fatalf("wait() of the replaced client error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the replaced client kept waiting")
+	}
+}
+
+func TestRepeaterWaitLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout time.Duration
+		data        string
+	}{
+		// one byte more than the limit after the ProtocolVersion
+		{"too much data", time.Hour, strings.Repeat("x", maxWaitingData-VERSION_LENGTH+1)},
+		{"wait timeout", 50 * time.Millisecond, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewRepeater()
+			r.WaitTimeout = tt.waitTimeout
+			go r.ServeServers(l)
+			defer r.Close()
+
+			c := dialRepeaterServer(t, l.Addr().String(), "1234")
+			defer c.Close()
+			eventually(t, "the server to wait", func() bool { return waitingServer(r, "1234") })
+			if _, err = c.Write([]byte(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+			expectClosed(t, c)
+			eventually(t, "the server to be dropped", func() bool { return !waitingServer(r, "1234") })
+		})
+	}
+}
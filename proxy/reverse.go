@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/lwydyby/logrus"
+)
+
+// ReverseHandler identifies a vnc server which connected to a ReverseListener and returns
+// the id it is registered under, an error rejects the server. The ProtocolVersion
+// the server sends first has been read already.
+type ReverseHandler func(c net.Conn) (id string, err error)
+
+// ReverseListener accepts the connections of vnc servers in reverse connection mode
+// (x11vnc -connect, vncconfig -connect) and keeps them until a websocket client of a Target
+// with Reverse set to their id attaches. A server connecting again replaces its waiting connection.
+type ReverseListener struct {
+	l       net.Listener
+	handler ReverseHandler
+	// HandshakeTimeout limits the time a server takes to send its ProtocolVersion and be identified,
+	// defaults to 10 seconds
+	HandshakeTimeout time.Duration
+	// WaitTimeout closes the connection of a server no client attached to in this time,
+	// defaults to an hour, 0 means no limit
+	WaitTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*reverseConn
+}
+
+// NewReverseListener returns a ReverseListener accepting vnc servers on l,
+// the servers are registered under their IP address when handler is nil
+func NewReverseListener(l net.Listener, handler ReverseHandler) *ReverseListener {
+	if handler == nil {
+		handler = func(c net.Conn) (string, error) {
+			host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+			return host, err
+		}
+	}
+	return &ReverseListener{
+		l:                l,
+		handler:          handler,
+		HandshakeTimeout: 10 * time.Second,
+		WaitTimeout:      time.Hour,
+		conns:            make(map[string]*reverseConn),
+	}
+}
+
+// Serve accept vnc servers until the listener fails or is closed
+func (rl *ReverseListener) Serve() error {
+	for {
+		c, err := rl.l.Accept()
+		if err != nil {
+			return err
+		}
+		go rl.register(c)
+	}
+}
+
+// Close stop accepting vnc servers and close the waiting connections
+func (rl *ReverseListener) Close() error {
+	err := rl.l.Close()
+	rl.mu.Lock()
+	conns := rl.conns
+	rl.conns = make(map[string]*reverseConn)
+	rl.mu.Unlock()
+	for _, rc := range conns {
+		rc.Conn.Close()
+	}
+	return err
+}
+
+// Waiting returns the ids of the vnc servers waiting for a client
+func (rl *ReverseListener) Waiting() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	ids := make([]string, 0, len(rl.conns))
+	for id := range rl.conns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Take remove the connection of the vnc server registered as id, to run the RFB handshake on it.
+// It returns false if no such server is waiting.
+func (rl *ReverseListener) Take(id string) (net.Conn, bool) {
+	rl.mu.Lock()
+	rc, ok := rl.conns[id]
+	delete(rl.conns, id)
+	rl.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return rc.take(), true
+}
+
+func (rl *ReverseListener) register(c net.Conn) {
+	if rl.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(rl.HandshakeTimeout))
+	}
+	version, err := recv(c, VERSION_LENGTH, "ProtocolVersion")
+	if err == nil {
+		_, err = normalizeVersion(version)
+	}
+	if err != nil {
+		log.Infof("vnc server %v in reverse mode failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	id, err := rl.handler(c)
+	if err != nil {
+		log.Infof("vnc server %v in reverse mode rejected: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	rc := newReverseConn(c, version)
+	rl.mu.Lock()
+	old := rl.conns[id]
+	rl.conns[id] = rc
+	rl.mu.Unlock()
+	if old != nil {
+		old.Conn.Close()
+	}
+	log.Infof("vnc server %v connected in reverse mode as %q", c.RemoteAddr(), id)
+	err = rc.watch(rl.WaitTimeout)
+	rl.mu.Lock()
+	if rl.conns[id] == rc {
+		delete(rl.conns, id)
+	}
+	rl.mu.Unlock()
+	if err != nil {
+		log.Infof("vnc server %v in reverse mode as %q disconnected: %v", c.RemoteAddr(), id, err)
+	}
+}
+
+// maxWaitingData is the most a waiting connection may receive before it is taken,
+// a vnc server sends nothing after its ProtocolVersion until the client answers
+const maxWaitingData = 4096
+
+var errWaitingDataTooLarge = errors.New("too much data received while waiting")
+
+// reverseConn is a connection waiting for its peer, e.g. of a vnc server in reverse mode,
+// its reads start with what was received while it was waiting
+type reverseConn struct {
+	net.Conn
+	buf     []byte
+	taken   chan struct{}
+	stopped chan struct{}
+}
+
+func newReverseConn(c net.Conn, buf []byte) *reverseConn {
+	return &reverseConn{Conn: c, buf: buf, taken: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// watch read from the waiting connection to notice when the other side goes away, until it is taken.
+// The connection is closed and the error returned if it failed, sent more than maxWaitingData
+// or was not taken within timeout (0 means no limit), watch returns nil once it is taken.
+func (rc *reverseConn) watch(timeout time.Duration) error {
+	defer close(rc.stopped)
+	if timeout > 0 {
+		rc.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	b := make([]byte, 256)
+	for {
+		n, err := rc.Conn.Read(b)
+		rc.buf = append(rc.buf, b[:n]...)
+		if err == nil && len(rc.buf) > maxWaitingData {
+			err = errWaitingDataTooLarge
+		}
+		if err == nil {
+			continue
+		}
+		select {
+		case <-rc.taken:
+			return nil
+		default:
+		}
+		rc.Conn.Close()
+		return err
+	}
+}
+
+// take stop watch, what it read is kept for the reads of the new owner.
+// take must be called once, after the connection was removed from where it waited.
+func (rc *reverseConn) take() *reverseConn {
+	close(rc.taken)
+	rc.Conn.SetReadDeadline(time.Now())
+	<-rc.stopped
+	rc.Conn.SetReadDeadline(time.Time{})
+	return rc
+}
+
+func (rc *reverseConn) Read(p []byte) (int, error) {
+	if len(rc.buf) > 0 {
+		n := copy(p, rc.buf)
+		rc.buf = rc.buf[n:]
+		return n, nil
+	}
+	return rc.Conn.Read(p)
+}
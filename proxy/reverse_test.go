@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventually polls cond for up to a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+// expectClosed fails unless the other side closes c
+func expectClosed(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() = %d, %v, want io.EOF", n, err)
+	}
+}
+
+func reverseListener(t *testing.T, handler ReverseHandler) (*ReverseListener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewReverseListener(l, handler)
+	go rl.Serve()
+	return rl, l.Addr().String()
+}
+
+// dialReverse connects to addr as a vnc server in reverse mode and sends data
+func dialReverse(t *testing.T, addr string, data string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReverseListenerTake(t *testing.T) {
+	rl, addr := reverseListener(t, nil)
+	defer rl.Close()
+
+	c := dialReverse(t, addr, "RFB 003.008\n")
+	defer c.Close()
+	eventually(t, "the server to wait", func() bool { return len(rl.Waiting()) == 1 })
+	if got := rl.Waiting(); !reflect.DeepEqual(got, []string{"127.0.0.1"}) {
+		t.Fatalf("Waiting() = %v, want the IP address of the server", got)
+	}
+	// sent while waiting, before the client attached
+	c.Write([]byte("early"))
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := rl.Take("10.0.0.1"); ok {
+		t.Fatal("Take() of an unknown id succeeded")
+	}
+	conn, ok := rl.Take("127.0.0.1")
+	if !ok {
+		t.Fatal("Take() of the waiting server failed")
+	}
+	defer conn.Close()
+	if got := rl.Waiting(); len(got) != 0 {
+		t.Fatalf("Waiting() after Take() = %v, want none", got)
+	}
+	c.Write([]byte("late"))
+	b := make([]byte, len("RFB 003.008\nearlylate"))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "RFB 003.008\nearlylate" {
+		t.Fatalf("read %q, %v from the taken connection, want everything the server sent", b, err)
+	}
+	if _, err := conn.Write([]byte("RFB 003.008\n")); err != nil {
+		t.Fatalf("Write() to the taken connection error = %v", err)
+	}
+}
+
+func TestReverseListenerDisconnect(t *testing.T) {
+	rl, addr := reverseListener(t, nil)
+	defer rl.Close()
+
+	c := dialReverse(t, addr, "RFB 003.008\n")
+	eventually(t, "the server to wait", func() bool { return len(rl.Waiting()) == 1 })
+	c.Close()
+	eventually(t, "the server to be dropped", func() bool { return len(rl.Waiting()) == 0 })
+}
+
+func TestReverseListenerReplace(t *testing.T) {
+	rl, addr := reverseListener(t, func(c net.Conn) (string, error) { return "vm", nil })
+	defer rl.Close()
+
+	first := dialReverse(t, addr, "RFB 003.008\n")
+	defer first.Close()
+	eventually(t, "the server to wait", func() bool { return len(rl.Waiting()) == 1 })
+	second := dialReverse(t, addr, "RFB 003.008\n")
+	defer second.Close()
+	expectClosed(t, first)
+	if got := rl.Waiting(); !reflect.DeepEqual(got, []string{"vm"}) {
+		t.Fatalf("Waiting() = %v, want [vm]", got)
+	}
+}
+
+func TestReverseListenerReject(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler ReverseHandler
+		data    string
+	}{
+		{"not a vnc server", nil, "GET / HTTP/1"},
+		{"rejected by the handler", func(c net.Conn) (string, error) { return "", errors.New("unknown server") }, "RFB 003.008\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, addr := reverseListener(t, tt.handler)
+			defer rl.Close()
+
+			c := dialReverse(t, addr, tt.data)
+			defer c.Close()
+			expectClosed(t, c)
+			if got := rl.Waiting(); len(got) != 0 {
+				t.Fatalf("Waiting() = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestReverseListenerHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewReverseListener(l, nil)
+	rl.HandshakeTimeout = 50 * time.Millisecond
+	go rl.Serve()
+	defer rl.Close()
+	addr := l.Addr().String()
+
+	c := dialReverse(t, addr, "RFB")
+	defer c.Close()
+	expectClosed(t, c)
+}
+
+func TestReverseListenerClose(t *testing.T) {
+	rl, addr := reverseListener(t, nil)
+
+	c := dialReverse(t, addr, "RFB 003.008\n")
+	defer c.Close()
+	eventually(t, "the server to wait", func() bool { return len(rl.Waiting()) == 1 })
+	rl.Close()
+	expectClosed(t, c)
+	if got := rl.Waiting(); len(got) != 0 {
+		t.Fatalf("Waiting() after Close() = %v, want none", got)
+	}
+}
+
+func TestReverseListenerWaitLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		waitTimeout time.Duration
+		data        string
+	}{
+		// exactly one byte too much, so that nothing is left unread when the connection is closed
+		{"too much data", time.Hour, "RFB 003.008\n" + strings.Repeat("x", maxWaitingData-VERSION_LENGTH+1)},
+		{"wait timeout", 50 * time.Millisecond, "RFB 003.008\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rl := NewReverseListener(l, nil)
+			rl.WaitTimeout = tt.waitTimeout
+			go rl.Serve()
+			defer rl.Close()
+
+			c := dialReverse(t, l.Addr().String(), tt.data)
+			defer c.Close()
+			expectClosed(t, c)
+			eventually(t, "the server to be dropped", func() bool { return len(rl.Waiting()) == 0 })
+		})
+	}
+}
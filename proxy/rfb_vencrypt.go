@@ -2,19 +2,20 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/des"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/lwydyby/go-vnc-proxy/conf"
+	"github.com/lwydyby/go-vnc-proxy/rfb"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"io"
+	"math"
+	"math/bits"
 	"net"
 	"reflect"
 	"strconv"
 	"strings"
-	"time"
 	"unsafe"
 )
 
@@ -24,6 +25,9 @@ const (
 	AUTH_STSTUS_FAIL = "\x00"
 	AUTH_STATUS_PASS = "\x01"
 	PVLEN            = 12
+	CHALLENGE_LENGTH = 16
+
+	MAX_REASON_LENGTH = 1 << 16
 )
 
 type AuthType = int
@@ -33,180 +37,616 @@ var (
 	NONE     AuthType = 1
 	VNC      AuthType = 2
 	VENCRYPT AuthType = 19
-	X509NONE          = 260
+
+	PLAIN     = 256
+	TLSNONE   = 257
+	TLSVNC    = 258
+	TLSPLAIN  = 259
+	X509NONE  = 260
+	X509VNC   = 261
+	X509PLAIN = 262
 )
 
-func Connect(addr string, source net.Conn, target net.Conn) (net.Conn, error) {
-	isVencrypt, err := checkIsVencrypt(addr)
+// VENCRYPT_SUBTYPES are the VeNCrypt sub-types the proxy supports, most preferred first.
+// Plain is never used because it would send the credentials unencrypted. The TLS* sub-types
+// are not supported: servers use anonymous Diffie-Hellman for them, which crypto/tls does not implement,
+// a server offering only them fails with ErrAnonymousTLS.
+var VENCRYPT_SUBTYPES = []AuthType{X509PLAIN, X509VNC, X509NONE}
+
+// handshake holds the state of the RFB handshake between
+// the websocket client (source) and the vnc backend (target)
+type handshake struct {
+	t       *Target
+	source  net.Conn
+	target  net.Conn
+	version float64
+	// clientAuth is set when the client passed the VNC Authentication of the backend itself,
+	// the proxy only relayed it
+	clientAuth bool
+}
+
+// Connect negotiate the RFB handshake between the websocket client and the vnc backend
+// on the single backend connection. Both legs use the highest version common to the client,
+// the backend and the proxy (3.3, 3.7 or 3.8). The security handshake is passed through
+// to the client unless VeNCrypt is used (see useVeNCrypt) or the target carries a VNC password,
+// in which case the proxy authenticates against the backend and offers None to the client.
+// When Connect returns both legs are positioned at ClientInit.
+func Connect(t *Target, source net.Conn, target net.Conn) (net.Conn, error) {
+	conn, _, err := negotiate(t, source, target)
+	return conn, err
+}
+
+// negotiate run Connect, it also reports whether the client authenticated itself
+// with the VNC Authentication of the backend
+func negotiate(t *Target, source net.Conn, target net.Conn) (net.Conn, bool, error) {
+	h := &handshake{t: t, source: source, target: target}
+	conn, err := h.connect()
+	return conn, h.clientAuth, err
+}
+
+func (h *handshake) connect() (net.Conn, error) {
+	t, target := h.t, h.target
+	err := h.negotiateVersion()
 	if err != nil {
 		return nil, err
 	}
-	if !isVencrypt {
-		return target, nil
-	}
-	serverName := strings.Split(addr, ":")[0]
-	targetVersion, err := recv(target, VERSION_LENGTH)
+	permittedAuthType, err := h.securityTypes()
 	if err != nil {
 		return nil, err
 	}
-	tv := parseVersion(targetVersion)
-	if tv != 3.8 {
-		return nil, errors.New("Security proxying requires RFB protocol version 3.8 , but tenant asked for " + string(targetVersion))
+	var authType AuthType
+	switch {
+	case useVeNCrypt(t, permittedAuthType):
+		authType = VENCRYPT
+	case t.Password != "" && hasAuthType(permittedAuthType, VNC):
+		authType = VNC
+	default:
+		return h.passthroughSecurity(permittedAuthType)
 	}
-	_, err = target.Write(targetVersion)
+	// the client always sees security type None, the proxy authenticates against the backend
+	err = h.offerNone()
 	if err != nil {
 		return nil, err
 	}
-	_, err = source.Write(targetVersion)
+	// with 3.3 the server has chosen the security type itself
+	if h.version != 3.3 {
+		err = send(target, uint8(authType))
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn := target
+	if authType == VNC {
+		err = vncAuth(target, t.Password)
+		if err == nil {
+			err = h.securityResult(target)
+		}
+	} else {
+		conn, err = h.securityHandshake()
+	}
 	if err != nil {
 		return nil, err
 	}
-	sourceVersion, err := recv(source, VERSION_LENGTH)
+	err = h.acceptClient()
 	if err != nil {
 		return nil, err
 	}
-	v := parseVersion(sourceVersion)
-	if v != 3.8 {
-		return nil, errors.New("Security proxying requires RFB protocol version 3.8 , but tenant asked for " + string(sourceVersion))
+	return conn, nil
+}
+
+// negotiateVersion offer the client the highest version supported by both the backend and the proxy,
+// then use the version the client answered on both legs
+func (h *handshake) negotiateVersion() error {
+	targetVersion, err := recv(h.target, VERSION_LENGTH, "ProtocolVersion")
+	if err != nil {
+		return err
+	}
+	tv, err := normalizeVersion(targetVersion)
+	if err != nil {
+		return err
+	}
+	_, err = h.source.Write([]byte(versionString(tv)))
+	if err != nil {
+		return err
+	}
+	sourceVersion, err := recv(h.source, VERSION_LENGTH, "ProtocolVersion")
+	if err != nil {
+		return err
 	}
+	v, err := normalizeVersion(sourceVersion)
+	if err != nil {
+		return err
+	}
+	h.version = math.Min(v, tv)
+	log.Debugf("Use RFB protocol version %v, server sent %q, client sent %q", h.version, targetVersion, sourceVersion)
+	_, err = h.target.Write([]byte(versionString(h.version)))
+	return err
+}
 
-	authType, err := recv(target, 1)
+// securityTypes read the security types offered by the backend, with 3.3 it is the single
+// type chosen by the server. A connection failure is forwarded to the client.
+func (h *handshake) securityTypes() ([]AuthType, error) {
+	if h.version == 3.3 {
+		var authType uint32
+		err := receive(h.target, &authType, "security type")
+		if err != nil {
+			return nil, err
+		}
+		if authType == uint32(INVALID) {
+			return nil, h.connectionFailed(make([]byte, 4))
+		}
+		return []AuthType{int(authType)}, nil
+	}
+	authTypeCnt, err := recv(h.target, 1, "number-of-security-types")
 	if err != nil {
 		return nil, err
 	}
-	if byte2int(authType) == 0 {
-		return nil, errors.New("negotiation failed: " + string(authType))
+	if byte2int(authTypeCnt) == 0 {
+		return nil, h.connectionFailed(authTypeCnt)
 	}
-	f, err := recv(target, byte2int(authType))
+	f, err := recv(h.target, byte2int(authTypeCnt), "security-types")
 	if err != nil {
 		return nil, err
 	}
-	permittedAuthType := make([]int, 0)
+	permittedAuthType := make([]AuthType, 0)
 	for _, t := range f {
 		permittedAuthType = append(permittedAuthType, int(t))
 	}
-	data := []byte("\x01\x01")
-	source.Write(data)
-	clientAuth, _ := recv(source, 1)
-	if byte2int(clientAuth) != NONE {
-		return nil, errors.New("negotiation failed: " + string(clientAuth))
+	return permittedAuthType, nil
+}
+
+// connectionFailed read the reason of a refused connection and forward it to the client
+func (h *handshake) connectionFailed(prefix []byte) error {
+	reason, err := recvReason(h.target)
+	if err != nil {
+		return err
 	}
-	if permittedAuthType[0] != VENCRYPT {
-		log.Warn("is not VENCRYPT conn")
-		return nil, errors.New("s not VENCRYPT conn")
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(reason)))
+	if h.source != nil {
+		h.source.Write(BytesCombine(prefix, length, reason))
 	}
-	target.Write(f)
-	return SecurityHandshake(serverName, target)
+	return classify(ErrBackendRefused, errors.New(string(reason)))
 }
 
-func checkIsVencrypt(addr string) (bool, error) {
-	target, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// clientHandshake run the RFB handshake with the vnc backend as a client of the proxy itself,
+// authenticating with the credentials of t, and exchange ClientInit and ServerInit.
+// It returns the connection to use afterwards, which is the TLS connection with VeNCrypt.
+func clientHandshake(t *Target, target net.Conn, shared bool) (net.Conn, *rfb.ServerInit, error) {
+	h := &handshake{t: t, target: target}
+	targetVersion, err := recv(target, VERSION_LENGTH, "ProtocolVersion")
 	if err != nil {
-		return false, err
+		return nil, nil, err
 	}
-	targetVersion, err := recv(target, VERSION_LENGTH)
+	h.version, err = normalizeVersion(targetVersion)
 	if err != nil {
-		return false, err
+		return nil, nil, err
 	}
-	tv := parseVersion(targetVersion)
-	if tv != 3.8 {
-		return false, errors.New("Security proxying requires RFB protocol version 3.8 , but tenant asked for " + string(targetVersion))
+	_, err = target.Write([]byte(versionString(h.version)))
+	if err != nil {
+		return nil, nil, err
 	}
-	_, err = target.Write(targetVersion)
+	permittedAuthType, err := h.securityTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	var authType AuthType
+	switch {
+	case useVeNCrypt(t, permittedAuthType):
+		authType = VENCRYPT
+	case t.Password != "" && hasAuthType(permittedAuthType, VNC):
+		authType = VNC
+	case hasAuthType(permittedAuthType, NONE):
+		authType = NONE
+	default:
+		return nil, nil, classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("no usable security type in %v", permittedAuthType)))
+	}
+	if h.version != 3.3 {
+		err = send(target, uint8(authType))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	conn := target
+	switch authType {
+	case NONE:
+		// only 3.8 sends a SecurityResult for security type None
+		if h.version == 3.8 {
+			err = h.securityResult(target)
+		}
+	case VNC:
+		err = vncAuth(target, t.Password)
+		if err == nil {
+			err = h.securityResult(target)
+		}
+	default:
+		conn, err = h.securityHandshake()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	clientInit := []byte{0}
+	if shared {
+		clientInit[0] = 1
+	}
+	_, err = conn.Write(clientInit)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverInit, err := rfb.ReadServerInit(conn)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, &ProtocolError{Msg: "ServerInit", Err: err}
+	}
+	return conn, serverInit, nil
+}
+
+// acceptHandshake run the server side of the RFB handshake with a client the proxy serves itself,
+// offering security type None, and send serverInit. It returns the shared-flag of ClientInit.
+func acceptHandshake(source net.Conn, serverInit *rfb.ServerInit) (bool, error) {
+	h := &handshake{source: source}
+	_, err := source.Write([]byte(versionString(3.8)))
 	if err != nil {
 		return false, err
 	}
-	authType, err := recv(target, 1)
+	sourceVersion, err := recv(source, VERSION_LENGTH, "ProtocolVersion")
 	if err != nil {
 		return false, err
 	}
-	if byte2int(authType) == 0 {
-		return false, errors.New("negotiation failed: " + string(authType))
+	h.version, err = normalizeVersion(sourceVersion)
+	if err != nil {
+		return false, err
 	}
-	f, err := recv(target, byte2int(authType))
+	err = h.offerNone()
 	if err != nil {
 		return false, err
 	}
-	permittedAuthType := make([]int, 0)
-	for _, t := range f {
-		permittedAuthType = append(permittedAuthType, int(t))
+	err = h.acceptClient()
+	if err != nil {
+		return false, err
 	}
-	err = target.Close()
+	clientInit, err := recv(source, 1, "ClientInit")
 	if err != nil {
 		return false, err
 	}
-	return permittedAuthType[0] == VENCRYPT, nil
+	_, err = source.Write(serverInit.Bytes())
+	return clientInit[0] != 0, err
+}
+
+// passthroughSecurity forward the security types None and VNC of the backend to the client
+// and relay the security handshake, so that both legs are at ClientInit when it returns.
+// Other security types cannot be relayed because the proxy must be able to parse what follows.
+func (h *handshake) passthroughSecurity(authTypes []AuthType) (net.Conn, error) {
+	permitted := make([]AuthType, 0, len(authTypes))
+	for _, t := range authTypes {
+		if t == NONE || t == VNC {
+			permitted = append(permitted, t)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("Server does not offer security type None or VNC: %v", authTypes)))
+	}
+	authType := permitted[0]
+	if h.version == 3.3 {
+		err := send(h.source, uint32(authType))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data := []byte{byte(len(permitted))}
+		for _, t := range permitted {
+			data = append(data, byte(t))
+		}
+		_, err := h.source.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		clientAuth, err := recv(h.source, 1, "security-type")
+		if err != nil {
+			return nil, err
+		}
+		authType = byte2int(clientAuth)
+		if !hasAuthType(permitted, authType) {
+			return nil, classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("client chose security type %v which was not offered", authType)))
+		}
+		_, err = h.target.Write(clientAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if authType == VNC {
+		h.clientAuth = true
+		err := h.relayVNCAuth()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// with 3.3 and 3.7 there is no SecurityResult for security type None
+	if authType == VNC || h.version == 3.8 {
+		err := h.relaySecurityResult()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.target, nil
+}
+
+// relayVNCAuth relay the VNC Authentication challenge to the client and its response back
+func (h *handshake) relayVNCAuth() error {
+	challenge, err := recv(h.target, CHALLENGE_LENGTH, "VNC Authentication challenge")
+	if err != nil {
+		return err
+	}
+	_, err = h.source.Write(challenge)
+	if err != nil {
+		return err
+	}
+	response, err := recv(h.source, CHALLENGE_LENGTH, "VNC Authentication response")
+	if err != nil {
+		return err
+	}
+	_, err = h.target.Write(response)
+	return err
+}
+
+// relaySecurityResult forward the SecurityResult of the backend to the client
+func (h *handshake) relaySecurityResult() error {
+	result, err := recv(h.target, 4, "SecurityResult")
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(result) == 0 {
+		_, err = h.source.Write(result)
+		return err
+	}
+	if h.version != 3.8 {
+		h.source.Write(result)
+		return ErrAuthFailed
+	}
+	reason, err := recvReason(h.target)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(reason)))
+	h.source.Write(BytesCombine(result, length, reason))
+	return classify(ErrAuthFailed, errors.New(string(reason)))
+}
+
+// offerNone offer security type None to the client
+func (h *handshake) offerNone() error {
+	if h.version == 3.3 {
+		return send(h.source, uint32(NONE))
+	}
+	data := []byte("\x01\x01")
+	_, err := h.source.Write(data)
+	if err != nil {
+		return err
+	}
+	clientAuth, err := recv(h.source, 1, "security-type")
+	if err != nil {
+		return err
+	}
+	if byte2int(clientAuth) != NONE {
+		return classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("client chose security type %v instead of None", byte2int(clientAuth))))
+	}
+	return nil
+}
+
+// acceptClient report the successful None authentication to the client,
+// only 3.8 sends a SecurityResult for security type None
+func (h *handshake) acceptClient() error {
+	if h.version != 3.8 {
+		return nil
+	}
+	return send(h.source, uint32(0))
+}
+
+// useVeNCrypt tells whether to choose VeNCrypt among the security types of the backend.
+// The sub-types are only known once VeNCrypt was chosen, and servers often offer the TLS* sub-types only
+// (e.g. TigerVNC's default TLSVnc,VncAuth), so VeNCrypt is preferred to VNC and None only when
+// the target has X509 settings, and otherwise used when the backend offers nothing else.
+func useVeNCrypt(t *Target, authTypes []AuthType) bool {
+	if !hasAuthType(authTypes, VENCRYPT) {
+		return false
+	}
+	return t.hasX509Config() || !hasAuthType(authTypes, VNC) && !hasAuthType(authTypes, NONE)
+}
+
+func hasAuthType(authTypes []AuthType, authType AuthType) bool {
+	for _, t := range authTypes {
+		if t == authType {
+			return true
+		}
+	}
+	return false
+}
+
+// vncAuth answer the DES challenge of VNC Authentication
+func vncAuth(c net.Conn, password string) error {
+	challenge, err := recv(c, CHALLENGE_LENGTH, "VNC Authentication challenge")
+	if err != nil {
+		return err
+	}
+	response, err := encryptChallenge(password, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(response)
+	return err
+}
+
+// encryptChallenge encrypt the challenge with the password as DES key,
+// VNC Authentication uses the key with the bit order of every byte reversed
+func encryptChallenge(password string, challenge []byte) ([]byte, error) {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, CHALLENGE_LENGTH)
+	for i := 0; i < CHALLENGE_LENGTH; i += block.BlockSize() {
+		block.Encrypt(response[i:i+block.BlockSize()], challenge[i:i+block.BlockSize()])
+	}
+	return response, nil
+}
+
+// securityResult read the SecurityResult message, with 3.8 a failed result carries a reason string
+func (h *handshake) securityResult(c net.Conn) error {
+	var result uint32
+	err := receive(c, &result, "SecurityResult")
+	if err != nil {
+		return err
+	}
+	if result == 0 {
+		return nil
+	}
+	if h.version != 3.8 {
+		return ErrAuthFailed
+	}
+	reason, err := recvReason(c)
+	if err != nil {
+		return err
+	}
+	return classify(ErrAuthFailed, errors.New(string(reason)))
 }
 
-func SecurityHandshake(serverName string, target net.Conn) (net.Conn, error) {
-	maj, _ := recv(target, 1)
-	min, _ := recv(target, 1)
-	majVer := byte2int(maj)
-	minVer := byte2int(min)
+// securityHandshake negotiate the best VeNCrypt sub-type the vnc backend offers,
+// run the TLS handshake and the inner VNC/Plain authentication with the target credentials
+func (h *handshake) securityHandshake() (net.Conn, error) {
+	t, target := h.t, h.target
+	ver, err := recv(target, 2, "VeNCrypt version")
+	if err != nil {
+		return nil, err
+	}
+	majVer := int(ver[0])
+	minVer := int(ver[1])
 	log.Debugf("Server sent VeNCrypt version %v.%v", majVer, minVer)
 	if majVer != 0 || minVer != 2 {
-		return nil, errors.New(fmt.Sprintf("Only VeNCrypt version 0.2 is supported by this proxy, but the server wanted to use version :%v.%v", majVer, minVer))
+		return nil, classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("Only VeNCrypt version 0.2 is supported by this proxy, but the server wanted to use version :%v.%v", majVer, minVer)))
 	}
 	data := [2]byte{'\x00', '\x02'}
-	err := send(target, data)
+	err = send(target, data)
 	if err != nil {
 		return nil, err
 	}
 	var isAccepted uint8
-	err = receive(target, &isAccepted)
+	err = receive(target, &isAccepted, "VeNCrypt version ack")
 	if err != nil {
 		return nil, err
 	}
 	if isAccepted > 0 {
-		return nil, errors.New("Server could not use VeNCrypt version 0.2 ")
+		return nil, classify(ErrUnsupportedSecurity, errors.New("Server could not use VeNCrypt version 0.2 "))
 	}
-	subTypesCnt, _ := recv(target, 1)
-	subAuthTypes := make([]int32, byte2int(subTypesCnt))
-	err = receiveN(target, &subAuthTypes, byte2int(subTypesCnt))
+	subTypesCnt, err := recv(target, 1, "VeNCrypt number-of-sub-types")
 	if err != nil {
 		return nil, err
 	}
-	hasX509 := false
-	for _, t := range subAuthTypes {
-		if t == int32(X509NONE) {
-			hasX509 = true
-			break
-		}
+	subAuthTypes := make([]int32, 0, byte2int(subTypesCnt))
+	err = receiveN(target, &subAuthTypes, byte2int(subTypesCnt), "VeNCrypt sub-types")
+	if err != nil {
+		return nil, err
+	}
+	subType, ok := chooseSubType(subAuthTypes, t)
+	if !ok && onlyAnonymousTLS(subAuthTypes) {
+		return nil, classify(ErrAnonymousTLS, errors.New(fmt.Sprintf("Server offers only the VeNCrypt sub-types %v, configure x509 credentials on it (e.g. tls-creds-x509 of QEMU) ", subAuthTypes)))
+	}
+	if !ok {
+		return nil, classify(ErrUnsupportedSecurity, errors.New(fmt.Sprintf("Server does not support any usable VeNCrypt sub-type: %v ", subAuthTypes)))
+	}
+	log.Debugf("Use VeNCrypt sub-type %v", subType)
+	err = send(target, uint32(subType))
+	if err != nil {
+		return nil, err
 	}
-	if !hasX509 {
-		return nil, errors.New("Server does not support the x509None VeNCrypt ")
+	authAccepted, err := recv(target, 1, "VeNCrypt sub-type ack")
+	if err != nil {
+		return nil, err
 	}
-	send(target, uint32(X509NONE))
-	authAccepted, _ := recv(target, 1)
 	if byte2int(authAccepted) == 0 {
-		return nil, errors.New("Server didn't accept the requested auth sub-type ")
+		return nil, classify(ErrUnsupportedSecurity, errors.New("Server didn't accept the requested auth sub-type "))
 	}
-	config := &tls.Config{
-		InsecureSkipVerify: true,
+	// the server certificate is always verified as configured for the target,
+	// the credentials sent next must not reach an unverified server
+	config, err := x509Config(t)
+	if err != nil {
+		return nil, classify(ErrTLS, err)
 	}
-	//fixme 对于没有使用双向加密的vnc,可能不需要证书
-	if conf.Conf.AppInfo.TLSCert != "" {
-		cert, err := tls.LoadX509KeyPair(conf.Conf.AppInfo.TLSCert, conf.Conf.AppInfo.TLSKey)
-		if err != nil {
-			panic(err)
+	conn := tls.Client(target, config)
+	err = conn.Handshake()
+	if err != nil {
+		return nil, classify(ErrTLS, err)
+	}
+	switch subType {
+	case X509VNC:
+		err = vncAuth(conn, t.Password)
+	case X509PLAIN:
+		err = plainAuth(conn, t.Username, t.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = h.securityResult(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// chooseSubType pick the most preferred VeNCrypt sub-type which the target has credentials for
+func chooseSubType(subAuthTypes []int32, t *Target) (int, bool) {
+	for _, subType := range VENCRYPT_SUBTYPES {
+		switch subType {
+		case X509VNC:
+			if t.Password == "" {
+				continue
+			}
+		case X509PLAIN:
+			if t.Username == "" || t.Password == "" {
+				continue
+			}
 		}
-		certBytes, err := ioutil.ReadFile(conf.Conf.AppInfo.TLSCaCerts)
-		if err != nil {
-			panic(err)
+		for _, offered := range subAuthTypes {
+			if offered == int32(subType) {
+				return subType, true
+			}
 		}
-		clientCertPool := x509.NewCertPool()
-		ok := clientCertPool.AppendCertsFromPEM(certBytes)
-		if !ok {
-			panic(err)
+	}
+	return INVALID, false
+}
+
+// onlyAnonymousTLS reports whether the server offers the TLS* sub-types but none of the X509* sub-types,
+// e.g. QEMU with tls-creds-anon
+func onlyAnonymousTLS(subAuthTypes []int32) bool {
+	anonymous := false
+	for _, subType := range subAuthTypes {
+		switch int(subType) {
+		case TLSNONE, TLSVNC, TLSPLAIN:
+			anonymous = true
+		case X509NONE, X509VNC, X509PLAIN:
+			return false
 		}
-		config.RootCAs = clientCertPool
-		config.Certificates = []tls.Certificate{cert}
 	}
-	conn := tls.Client(target, config)
-	return conn, nil
+	return anonymous
 }
 
-func receiveN(c net.Conn, data interface{}, n int) error {
+// plainAuth send the username and password of VeNCrypt Plain authentication
+func plainAuth(c net.Conn, username, password string) error {
+	err := send(c, [2]uint32{uint32(len(username)), uint32(len(password))})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write([]byte(username + password))
+	return err
+}
+
+func receiveN(c net.Conn, data interface{}, n int, msg string) error {
 	if n == 0 {
 		return nil
 	}
@@ -216,7 +656,7 @@ func receiveN(c net.Conn, data interface{}, n int) error {
 		var v uint8
 		for i := 0; i < n; i++ {
 			if err := binary.Read(c, binary.BigEndian, &v); err != nil {
-				return err
+				return &ProtocolError{Msg: msg, Err: err}
 			}
 			slice := data.(*[]uint8)
 			*slice = append(*slice, v)
@@ -225,7 +665,7 @@ func receiveN(c net.Conn, data interface{}, n int) error {
 		var v int32
 		for i := 0; i < n; i++ {
 			if err := binary.Read(c, binary.BigEndian, &v); err != nil {
-				return err
+				return &ProtocolError{Msg: msg, Err: err}
 			}
 			slice := data.(*[]int32)
 			*slice = append(*slice, v)
@@ -234,7 +674,7 @@ func receiveN(c net.Conn, data interface{}, n int) error {
 		var v byte
 		for i := 0; i < n; i++ {
 			if err := binary.Read(c, binary.BigEndian, &v); err != nil {
-				return err
+				return &ProtocolError{Msg: msg, Err: err}
 			}
 			buf := data.(*bytes.Buffer)
 			buf.WriteByte(v)
@@ -245,9 +685,9 @@ func receiveN(c net.Conn, data interface{}, n int) error {
 	return nil
 }
 
-func receive(c net.Conn, data interface{}) error {
+func receive(c net.Conn, data interface{}, msg string) error {
 	if err := binary.Read(c, binary.BigEndian, data); err != nil {
-		return err
+		return &ProtocolError{Msg: msg, Err: err}
 	}
 	return nil
 }
@@ -281,27 +721,58 @@ func byte2int(data []byte) int {
 	return ret
 }
 
-func parseVersion(version []byte) float64 {
+// normalizeVersion map a ProtocolVersion message to the version the proxy speaks:
+// 3.8 and later are treated as 3.8, other versions before 3.7 as 3.3
+func normalizeVersion(version []byte) (float64, error) {
 	versionStr := string(version)
-
-	result, _ := strconv.ParseFloat(fmt.Sprintf("%v.%v", str2int(versionStr[4:7]), str2int(versionStr[8:11])), 1)
-	return result
+	if !strings.HasPrefix(versionStr, "RFB ") || versionStr[7] != '.' || versionStr[11] != '\n' {
+		return 0, &ProtocolError{Msg: "ProtocolVersion", Err: ErrMalformed}
+	}
+	maj, err := strconv.Atoi(versionStr[4:7])
+	if err != nil {
+		return 0, &ProtocolError{Msg: "ProtocolVersion", Err: ErrMalformed}
+	}
+	min, err := strconv.Atoi(versionStr[8:11])
+	if err != nil {
+		return 0, &ProtocolError{Msg: "ProtocolVersion", Err: ErrMalformed}
+	}
+	switch {
+	case maj < 3:
+		return 0, &ProtocolError{Msg: "ProtocolVersion", Err: errors.New(fmt.Sprintf("unsupported version %q", versionStr))}
+	case maj > 3 || min >= 8:
+		return 3.8, nil
+	case min == 7:
+		return 3.7, nil
+	default:
+		return 3.3, nil
+	}
 }
-func str2int(s string) int {
-	result, _ := strconv.Atoi(s)
-	return result
+
+func versionString(version float64) string {
+	return fmt.Sprintf("RFB 003.00%v\n", int(math.Round(version*10))%10)
 }
 
-func recv(c net.Conn, num int) ([]byte, error) {
+// recv read exactly num bytes of the RFB message msg
+func recv(c net.Conn, num int, msg string) ([]byte, error) {
 	buf := make([]byte, num)
-	length, err := c.Read(buf)
+	_, err := io.ReadFull(c, buf)
+	if err != nil {
+		return nil, &ProtocolError{Msg: msg, Err: err}
+	}
+	return buf, nil
+}
+
+// recvReason read the length prefixed reason string of a failure message
+func recvReason(c net.Conn) ([]byte, error) {
+	var reasonLen uint32
+	err := receive(c, &reasonLen, "reason-length")
 	if err != nil {
 		return nil, err
 	}
-	if length != num {
-		log.Warnf("Incorrect read from socket, wanted %v bytes but got %v. Socket returned", num, length)
+	if reasonLen > MAX_REASON_LENGTH {
+		return nil, &ProtocolError{Msg: "reason-length", Err: ErrMalformed}
 	}
-	return buf, nil
+	return recv(c, int(reasonLen), "reason-string")
 }
 
 //BytesCombine 多个[]byte数组合并成一个[]byte
@@ -0,0 +1,822 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// step is a message a scripted handshake peer sends, or the message it expects next
+type step struct {
+	send   []byte
+	expect []byte
+}
+
+// scripted runs the steps on the far end of a pipe and returns the near end,
+// done receives the first deviation from the script
+func scripted(steps ...step) (net.Conn, chan error) {
+	near, far := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer far.Close()
+		done <- runSteps(far, steps)
+	}()
+	return near, done
+}
+
+func runSteps(c net.Conn, steps []step) error {
+	for i, s := range steps {
+		if s.send != nil {
+			if _, err := c.Write(s.send); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		}
+		if s.expect != nil {
+			b := make([]byte, len(s.expect))
+			if _, err := io.ReadFull(c, b); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+			if !bytes.Equal(b, s.expect) {
+				return fmt.Errorf("step %d: got %x, want %x", i, b, s.expect)
+			}
+		}
+	}
+	return nil
+}
+
+func writes(b ...byte) step {
+	return step{send: b}
+}
+
+func reads(b ...byte) step {
+	return step{expect: b}
+}
+
+func writeString(s string) step {
+	return step{send: []byte(s)}
+}
+
+func readString(s string) step {
+	return step{expect: []byte(s)}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// testChallenge is answered with testResponse for the password "password"
+var (
+	testChallenge = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	testResponse  = mustHex("b866924125c8eebb9debc1db61c538e2")
+)
+
+func TestEncryptChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		password  string
+		challenge []byte
+		want      []byte
+	}{
+		{"password", "password", testChallenge, testResponse},
+		{"only the first 8 characters are used", "password123", testChallenge, testResponse},
+		{"short password", "secret", testChallenge, mustHex("ee22539f33a5983ec12f9c2edbc995dd")},
+		{"empty password", "", testChallenge, mustHex("491e890de9ace932838a49792f2213f3")},
+		// the fixed key of the vncpasswd files, which encrypts "password" to dbd83cfd727a1458
+		{"vncpasswd key", "\x17\x52\x6b\x06\x23\x4e\x58\x07", []byte("passwordpassword"), mustHex("dbd83cfd727a1458dbd83cfd727a1458")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encryptChallenge(tt.password, tt.challenge)
+			if err != nil {
+				t.Fatalf("encryptChallenge() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("encryptChallenge() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectVNCAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend []step
+		client  []step
+		wantErr error
+	}{
+		{
+			name: "3.8",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse},
+				writes(0, 0, 0, 0),
+			},
+			// the client sees security type None
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)),
+				reads(0, 0, 0, 0),
+			},
+		},
+		{
+			name: "3.3",
+			backend: []step{
+				writeString("RFB 003.003\n"), readString("RFB 003.003\n"),
+				writes(0, 0, 0, byte(VNC)),
+				{send: testChallenge, expect: testResponse},
+				writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.003\n"), writeString("RFB 003.003\n"),
+				reads(0, 0, 0, byte(NONE)),
+			},
+		},
+		{
+			name: "authentication failed",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse},
+				writes(0, 0, 0, 1, 0, 0, 0, 4, 'n', 'o', 'p', 'e'),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)),
+			},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			name: "client refuses None",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(VNC)),
+			},
+			wantErr: ErrUnsupportedSecurity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, backendDone := scripted(tt.backend...)
+			defer target.Close()
+			source, clientDone := scripted(tt.client...)
+			defer source.Close()
+
+			_, err := Connect(&Target{Addr: "127.0.0.1:5900", Password: "password"}, source, target)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			if err = <-backendDone; err != nil {
+				t.Fatalf("backend: %v", err)
+			}
+			if err = <-clientDone; err != nil {
+				t.Fatalf("client: %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectPassthrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend []step
+		client  []step
+		// clientAuth is set when the client answered the VNC Authentication itself
+		clientAuth bool
+	}{
+		{
+			name: "3.8 None",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(NONE)), reads(byte(NONE)), writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)), reads(0, 0, 0, 0),
+			},
+		},
+		{
+			name: "3.8 VNC",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				// Tight cannot be relayed
+				writes(2, 16, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse}, writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(VNC)), writes(byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, reads(0, 0, 0, 0),
+			},
+			clientAuth: true,
+		},
+		{
+			name: "3.7 None",
+			backend: []step{
+				writeString("RFB 003.007\n"), readString("RFB 003.007\n"),
+				writes(2, byte(NONE), byte(VNC)), reads(byte(NONE)),
+			},
+			// no SecurityResult for None before 3.8
+			client: []step{
+				readString("RFB 003.007\n"), writeString("RFB 003.007\n"),
+				reads(2, byte(NONE), byte(VNC)), writes(byte(NONE)),
+			},
+		},
+		{
+			name: "3.7 VNC",
+			backend: []step{
+				writeString("RFB 003.007\n"), readString("RFB 003.007\n"),
+				writes(2, byte(NONE), byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse}, writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.007\n"), writeString("RFB 003.007\n"),
+				reads(2, byte(NONE), byte(VNC)), writes(byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, reads(0, 0, 0, 0),
+			},
+			clientAuth: true,
+		},
+		{
+			name: "3.3 None",
+			backend: []step{
+				writeString("RFB 003.003\n"), readString("RFB 003.003\n"),
+				writes(0, 0, 0, byte(NONE)),
+			},
+			client: []step{
+				readString("RFB 003.003\n"), writeString("RFB 003.003\n"),
+				reads(0, 0, 0, byte(NONE)),
+			},
+		},
+		{
+			name: "3.3 VNC",
+			backend: []step{
+				writeString("RFB 003.003\n"), readString("RFB 003.003\n"),
+				writes(0, 0, 0, byte(VNC)),
+				{send: testChallenge, expect: testResponse}, writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.003\n"), writeString("RFB 003.003\n"),
+				reads(0, 0, 0, byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, reads(0, 0, 0, 0),
+			},
+			clientAuth: true,
+		},
+		{
+			name: "client older than the backend",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.003\n"),
+				writes(0, 0, 0, byte(NONE)),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.003\n"),
+				reads(0, 0, 0, byte(NONE)),
+			},
+		},
+		{
+			name: "client newer than the backend",
+			backend: []step{
+				writeString("RFB 003.007\n"), readString("RFB 003.007\n"),
+				writes(1, byte(NONE)), reads(byte(NONE)),
+			},
+			client: []step{
+				readString("RFB 003.007\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)),
+			},
+		},
+		{
+			name: "Apple Remote Desktop version",
+			backend: []step{
+				writeString("RFB 003.889\n"), readString("RFB 003.008\n"),
+				writes(1, byte(NONE)), reads(byte(NONE)), writes(0, 0, 0, 0),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)), reads(0, 0, 0, 0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, backendDone := scripted(tt.backend...)
+			defer target.Close()
+			source, clientDone := scripted(tt.client...)
+			defer source.Close()
+
+			_, clientAuth, err := negotiate(&Target{Addr: "127.0.0.1:5900"}, source, target)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			if clientAuth != tt.clientAuth {
+				t.Fatalf("Connect() client authenticated = %v, want %v", clientAuth, tt.clientAuth)
+			}
+			if err = <-backendDone; err != nil {
+				t.Fatalf("backend: %v", err)
+			}
+			if err = <-clientDone; err != nil {
+				t.Fatalf("client: %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectFailure(t *testing.T) {
+	reason := concat(u32(12), []byte("bad password"))
+	tests := []struct {
+		name    string
+		backend []step
+		// client ends with what the client receives of the failure
+		client  []step
+		wantErr error
+	}{
+		{
+			name: "3.8 authentication failed",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse}, {send: concat(u32(1), reason)},
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(VNC)), writes(byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, {expect: concat(u32(1), reason)},
+			},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			// no reason string before 3.8
+			name: "3.7 authentication failed",
+			backend: []step{
+				writeString("RFB 003.007\n"), readString("RFB 003.007\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse}, {send: u32(1)},
+			},
+			client: []step{
+				readString("RFB 003.007\n"), writeString("RFB 003.007\n"),
+				reads(1, byte(VNC)), writes(byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, {expect: u32(1)},
+			},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			name: "3.3 authentication failed",
+			backend: []step{
+				writeString("RFB 003.003\n"), readString("RFB 003.003\n"),
+				writes(0, 0, 0, byte(VNC)),
+				{send: testChallenge, expect: testResponse}, {send: u32(1)},
+			},
+			client: []step{
+				readString("RFB 003.003\n"), writeString("RFB 003.003\n"),
+				reads(0, 0, 0, byte(VNC)),
+				{expect: testChallenge}, {send: testResponse}, {expect: u32(1)},
+			},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			name: "3.8 connection refused",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				{send: concat([]byte{0}, reason)},
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				{expect: concat([]byte{0}, reason)},
+			},
+			wantErr: ErrBackendRefused,
+		},
+		{
+			name: "3.7 connection refused",
+			backend: []step{
+				writeString("RFB 003.007\n"), readString("RFB 003.007\n"),
+				{send: concat([]byte{0}, reason)},
+			},
+			client: []step{
+				readString("RFB 003.007\n"), writeString("RFB 003.007\n"),
+				{expect: concat([]byte{0}, reason)},
+			},
+			wantErr: ErrBackendRefused,
+		},
+		{
+			name: "3.3 connection refused",
+			backend: []step{
+				writeString("RFB 003.003\n"), readString("RFB 003.003\n"),
+				{send: concat(u32(0), reason)},
+			},
+			client: []step{
+				readString("RFB 003.003\n"), writeString("RFB 003.003\n"),
+				{expect: concat(u32(0), reason)},
+			},
+			wantErr: ErrBackendRefused,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, backendDone := scripted(tt.backend...)
+			defer target.Close()
+			// a pipe write blocks until it is read, anything sent after the failure would stall Connect
+			source, clientDone := scripted(tt.client...)
+			defer source.Close()
+
+			_, err := Connect(&Target{Addr: "127.0.0.1:5900"}, source, target)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			if err = <-backendDone; err != nil {
+				t.Fatalf("backend: %v", err)
+			}
+			if err = <-clientDone; err != nil {
+				t.Fatalf("client: %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend []step
+		client  []step
+		// msg is the message reported truncated
+		msg string
+	}{
+		{
+			name:    "ProtocolVersion of the backend",
+			backend: []step{writeString("RFB 003")},
+			msg:     "ProtocolVersion",
+		},
+		{
+			name:    "ProtocolVersion of the client",
+			backend: []step{writeString("RFB 003.008\n")},
+			client:  []step{readString("RFB 003.008\n"), writeString("RFB 00")},
+			msg:     "ProtocolVersion",
+		},
+		{
+			name:    "security types",
+			backend: []step{writeString("RFB 003.008\n"), readString("RFB 003.008\n"), writes(2, byte(VNC))},
+			client:  []step{readString("RFB 003.008\n"), writeString("RFB 003.008\n")},
+			msg:     "security-types",
+		},
+		{
+			name:    "security type of 3.3",
+			backend: []step{writeString("RFB 003.003\n"), readString("RFB 003.003\n"), writes(0, 0)},
+			client:  []step{readString("RFB 003.003\n"), writeString("RFB 003.003\n")},
+			msg:     "security type",
+		},
+		{
+			name: "reason string",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				{send: concat([]byte{0}, u32(12), []byte("bad"))},
+			},
+			client: []step{readString("RFB 003.008\n"), writeString("RFB 003.008\n")},
+			msg:    "reason-string",
+		},
+		{
+			name: "VNC Authentication challenge",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)), {send: testChallenge[:8]},
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)),
+			},
+			msg: "VNC Authentication challenge",
+		},
+		{
+			name: "SecurityResult",
+			backend: []step{
+				writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+				writes(1, byte(VNC)), reads(byte(VNC)),
+				{send: testChallenge, expect: testResponse}, writes(0, 0),
+			},
+			client: []step{
+				readString("RFB 003.008\n"), writeString("RFB 003.008\n"),
+				reads(1, byte(NONE)), writes(byte(NONE)),
+			},
+			msg: "SecurityResult",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := scripted(tt.backend...)
+			defer target.Close()
+			source, _ := scripted(tt.client...)
+			defer source.Close()
+
+			_, err := Connect(&Target{Addr: "127.0.0.1:5900", Password: "password"}, source, target)
+			var pe *ProtocolError
+			if !errors.As(err, &pe) || pe.Msg != tt.msg {
+				t.Fatalf("Connect() error = %v, want a ProtocolError of %v", err, tt.msg)
+			}
+			if code, _ := CloseCode(err); code != CloseProtocolError {
+				t.Fatalf("CloseCode() = %d, want %d", code, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestNormalizeVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    float64
+		wantErr bool
+	}{
+		{"RFB 003.003\n", 3.3, false},
+		// e.g. UltraVNC, treated as 3.3
+		{"RFB 003.005\n", 3.3, false},
+		{"RFB 003.006\n", 3.3, false},
+		{"RFB 003.007\n", 3.7, false},
+		{"RFB 003.008\n", 3.8, false},
+		// Apple Remote Desktop
+		{"RFB 003.889\n", 3.8, false},
+		{"RFB 004.000\n", 3.8, false},
+		{"RFB 004.001\n", 3.8, false},
+		{"RFB 002.000\n", 0, true},
+		{"RFB 000.000\n", 0, true},
+		{"RFB 003.008 ", 0, true},
+		{"RFB 003-008\n", 0, true},
+		{"RFB 00a.008\n", 0, true},
+		{"RFB 003.0x8\n", 0, true},
+		{"HTTP/1.1 200", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := normalizeVersion([]byte(tt.version))
+			if tt.wantErr {
+				var pe *ProtocolError
+				if !errors.As(err, &pe) {
+					t.Fatalf("normalizeVersion(%q) error = %v, want a ProtocolError", tt.version, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("normalizeVersion(%q) = %v, %v, want %v", tt.version, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUseVeNCrypt(t *testing.T) {
+	x509Target := &Target{TLS: &TLSConfig{}}
+	tests := []struct {
+		name      string
+		t         *Target
+		authTypes []AuthType
+		want      bool
+	}{
+		{"not offered", x509Target, []AuthType{VNC}, false},
+		{"X509 settings", x509Target, []AuthType{VNC, VENCRYPT}, true},
+		// TigerVNC's default TLSVnc,VncAuth, the anonymous TLS sub-types cannot be used
+		{"VNC without X509 settings", &Target{Password: "password"}, []AuthType{VENCRYPT, VNC}, false},
+		{"None without X509 settings", &Target{}, []AuthType{NONE, VENCRYPT}, false},
+		{"only VeNCrypt", &Target{}, []AuthType{VENCRYPT}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := useVeNCrypt(tt.t, tt.authTypes); got != tt.want {
+				t.Fatalf("useVeNCrypt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseSubType(t *testing.T) {
+	all := []int32{int32(PLAIN), int32(TLSNONE), int32(TLSVNC), int32(TLSPLAIN), int32(X509NONE), int32(X509VNC), int32(X509PLAIN)}
+	tests := []struct {
+		name     string
+		subTypes []int32
+		t        *Target
+		want     int
+		wantOK   bool
+	}{
+		{"username and password", all, &Target{Username: "user", Password: "password"}, X509PLAIN, true},
+		{"password", all, &Target{Password: "password"}, X509VNC, true},
+		{"no credentials", all, &Target{}, X509NONE, true},
+		{"username without password", []int32{int32(X509PLAIN), int32(X509NONE)}, &Target{Username: "user"}, X509NONE, true},
+		{"anonymous TLS only", []int32{int32(TLSNONE), int32(TLSVNC), int32(TLSPLAIN)}, &Target{Password: "password"}, INVALID, false},
+		{"Plain only", []int32{int32(PLAIN)}, &Target{Username: "user", Password: "password"}, INVALID, false},
+		{"X509Vnc without password", []int32{int32(X509VNC)}, &Target{}, INVALID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := chooseSubType(tt.subTypes, tt.t)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("chooseSubType() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and the name of a CA file holding it,
+// the caller removes the file
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vnc backend"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "vnc-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, f.Name()
+}
+
+// vencryptServer scripts a 3.8 backend offering VeNCrypt with the sub-types, it expects
+// the choice and runs the steps on the TLS connection
+func vencryptServer(cert tls.Certificate, subTypes []AuthType, choice AuthType, steps ...step) (net.Conn, chan error) {
+	offer := []byte{byte(len(subTypes))}
+	for _, subType := range subTypes {
+		offer = append(offer, u32(uint32(subType))...)
+	}
+	near, far := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer far.Close()
+		err := runSteps(far, []step{
+			writeString("RFB 003.008\n"), readString("RFB 003.008\n"),
+			writes(1, byte(VENCRYPT)), reads(byte(VENCRYPT)),
+			writes(0, 2), reads(0, 2), writes(0),
+			{send: offer, expect: u32(uint32(choice))}, writes(1),
+		})
+		if err != nil {
+			done <- err
+			return
+		}
+		conn := tls.Server(far, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err = conn.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		done <- runSteps(conn, steps)
+	}()
+	return near, done
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func TestClientHandshakeVeNCrypt(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	defer os.Remove(caFile)
+	serverInit := &rfb.ServerInit{Width: 800, Height: 600, PixelFormat: rfb.PixelFormat{BPP: 32, Depth: 24, TrueColour: true,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}, Name: "vm"}
+	// the backend reports success, reads the shared-flag and sends ServerInit
+	accept := []step{writes(0, 0, 0, 0), reads(1), {send: serverInit.Bytes()}}
+	verified := &TLSConfig{CACerts: caFile}
+	offered := []AuthType{TLSVNC, X509NONE, X509VNC, X509PLAIN}
+
+	tests := []struct {
+		name    string
+		t       *Target
+		offered []AuthType
+		choice  AuthType
+		inner   []step
+		wantErr error
+	}{
+		{
+			name:    "X509None",
+			t:       &Target{TLS: verified},
+			offered: offered,
+			choice:  X509NONE,
+			inner:   accept,
+		},
+		{
+			name:    "X509Vnc",
+			t:       &Target{Password: "password", TLS: verified},
+			offered: offered,
+			choice:  X509VNC,
+			inner:   append([]step{{send: testChallenge, expect: testResponse}}, accept...),
+		},
+		{
+			name:    "X509Plain",
+			t:       &Target{Username: "user", Password: "password", TLS: verified},
+			offered: offered,
+			choice:  X509PLAIN,
+			inner:   append([]step{{expect: concat(u32(4), u32(8), []byte("userpassword"))}}, accept...),
+		},
+		{
+			name:    "InsecureSkipVerify",
+			t:       &Target{TLS: &TLSConfig{InsecureSkipVerify: true}},
+			offered: offered,
+			choice:  X509NONE,
+			inner:   accept,
+		},
+		{
+			name:    "unknown certificate authority",
+			t:       &Target{Password: "password", TLS: &TLSConfig{}},
+			offered: offered,
+			choice:  X509VNC,
+			wantErr: ErrTLS,
+		},
+		{
+			name:    "server name mismatch",
+			t:       &Target{Password: "password", TLS: &TLSConfig{CACerts: caFile, ServerName: "vnc.example.com"}},
+			offered: offered,
+			choice:  X509VNC,
+			wantErr: ErrTLS,
+		},
+		{
+			name:    "authentication failed",
+			t:       &Target{Password: "password", TLS: verified},
+			offered: offered,
+			choice:  X509VNC,
+			inner:   []step{{send: testChallenge, expect: testResponse}, writes(0, 0, 0, 1, 0, 0, 0, 0)},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			// crypto/tls does not implement the anonymous Diffie-Hellman of the TLS* sub-types
+			name:    "anonymous TLS only",
+			t:       &Target{Password: "password"},
+			offered: []AuthType{TLSNONE, TLSVNC},
+			wantErr: ErrAnonymousTLS,
+		},
+		{
+			name:    "X509Vnc without password",
+			t:       &Target{TLS: verified},
+			offered: []AuthType{TLSVNC, X509VNC},
+			wantErr: ErrUnsupportedSecurity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.t.Addr = "127.0.0.1:5900"
+			target, done := vencryptServer(cert, tt.offered, tt.choice, tt.inner...)
+			defer target.Close()
+
+			_, got, err := clientHandshake(tt.t, target, true)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("clientHandshake() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clientHandshake() error = %v", err)
+			}
+			if *got != *serverInit {
+				t.Fatalf("clientHandshake() ServerInit = %#v, want %#v", got, serverInit)
+			}
+			if err = <-done; err != nil {
+				t.Fatalf("backend: %v", err)
+			}
+		})
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
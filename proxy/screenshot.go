@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+)
+
+// Screenshot connect to the vnc backend of t as a Client and return its screen once received.
+// Config.HandshakeTimeout limits both the handshake and the wait for the screen.
+// Like Dial it rejects Reverse and Repeater targets.
+func Screenshot(t *Target, conf *Config) (*image.RGBA, error) {
+	c, err := Dial(t, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if conf != nil && conf.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.HandshakeTimeout)
+		defer cancel()
+	}
+	err = c.waitFor(ctx, func() bool { return c.updates > 0 })
+	if err != nil {
+		return nil, err
+	}
+	return c.Image(), nil
+}
+
+// hasPixels reports whether the update carries pixel data rather than pseudo-encodings only
+func hasPixels(fu *rfb.FramebufferUpdate) bool {
+	for _, r := range fu.Rects {
+		switch r.Encoding {
+		case rfb.EncodingRaw, rfb.EncodingCopyRect, rfb.EncodingRRE, rfb.EncodingCoRRE, rfb.EncodingHextile,
+			rfb.EncodingZlib, rfb.EncodingTight, rfb.EncodingZRLE, rfb.EncodingTightPNG:
+			return true
+		}
+	}
+	return false
+}
+
+// ServeScreenshot write the screen of the vnc backend which the TokenHandler resolves for the request,
+// as PNG or with format=jpeg as JPEG of the quality 1 to 100 given by quality
+func (p *Proxy) ServeScreenshot(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	quality := jpeg.DefaultQuality
+	switch format {
+	case "", "png":
+	case "jpeg", "jpg":
+		if v := q.Get("quality"); v != "" {
+			var err error
+			quality, err = strconv.Atoi(v)
+			if err != nil || quality < 1 || quality > 100 {
+				http.Error(w, "quality must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "unknown format "+strconv.Quote(format), http.StatusBadRequest)
+		return
+	}
+
+	target, err := p.tokenHandler(r)
+	if err != nil {
+		log.Infof("get vnc backend failed: %v", err)
+		http.Error(w, ErrTokenRejected.Error(), http.StatusForbidden)
+		return
+	}
+	img, err := Screenshot(target, p.conf)
+	if err == ErrWaitingTarget {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Infof("screenshot failed: %v", err)
+		_, reason := CloseCode(err)
+		http.Error(w, reason, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "jpeg" || format == "jpg" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		err = png.Encode(w, img)
+	}
+	if err != nil {
+		log.Infof("write screenshot failed: %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+	log "github.com/lwydyby/logrus"
+)
+
+// InputPolicy decides whose input a shared session forwards to the vnc backend,
+// the input of read-only peers is never forwarded
+type InputPolicy int
+
+const (
+	// InputAll forwards the input of every peer
+	InputAll InputPolicy = iota
+	// InputOwner forwards only the input of the peer that joined first,
+	// the control passes to the next peer when it leaves
+	InputOwner
+)
+
+// slowPeerTimeout is how long a shared session waits for a peer which does not keep up
+// before the peer is disconnected, so that it cannot stall the other peers
+const slowPeerTimeout = 10 * time.Second
+
+// session is a vnc backend connection and the peers viewing it.
+// The server messages are parsed once and fanned out to every peer.
+// A shared session is opened by the first peer of a Target with Shared set,
+// the settings of its Target apply to the whole session.
+type session struct {
+	// key identifies a shared session, it is empty when the session is not shared
+	key      string
+	t        *Target
+	target   net.Conn
+	reader   *rfb.ServerReader
+	recorder *recorder
+	// ready is closed once the first peer finished the handshake, err tells whether it failed
+	ready chan struct{}
+	err   error
+	// joinable is false when the first peer passed the VNC Authentication of the backend itself,
+	// the other clients then connect on their own, authenticating as well
+	joinable bool
+	// onClose is called when the session ends
+	onClose func()
+
+	// wl serializes the messages written to the backend
+	wl sync.Mutex
+
+	l          sync.Mutex
+	serverInit rfb.ServerInit
+	// cursor is the last cursor shape, sent to the peers joining later
+	cursor *rfb.Rectangle
+	peers  []*peer
+	// encodings were last sent to the backend by a shared session, see updateEncodings
+	encodings []int32
+	closed    bool
+}
+
+func newSession(t *Target, key string) *session {
+	return &session{key: key, t: t, ready: make(chan struct{})}
+}
+
+// start set up the session on the backend connection after the handshake,
+// run reads the server messages once the first peer was added
+func (s *session) start(conn net.Conn, serverInit *rfb.ServerInit) error {
+	s.target = conn
+	s.serverInit = *serverInit
+	s.reader = rfb.NewServerReader(conn, serverInit.PixelFormat)
+	if s.t.RecordPath != "" {
+		var err error
+		s.recorder, err = newRecorder(s.t.RecordPath, s.t.RecordInput, serverInit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opened records the result of the handshake of the first peer and wakes up the peers waiting to join
+func (s *session) opened(err error) {
+	s.err = err
+	close(s.ready)
+}
+
+func (s *session) run() {
+	for {
+		msg, err := s.reader.ReadMessage()
+		if err != nil {
+			s.l.Lock()
+			closed := s.closed
+			s.l.Unlock()
+			if !closed && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Infof("read vnc backend(%v) message failed: %v", s.target.RemoteAddr(), err)
+			}
+			switch {
+			case err == io.EOF:
+				s.close(ErrBackendClosed)
+			case isParseError(err):
+				s.close(&ProtocolError{Msg: "server message", Err: err})
+			default:
+				s.close(classify(ErrBackendClosed, err))
+			}
+			return
+		}
+		s.update(msg)
+		data := msg.Bytes()
+		if s.recorder != nil {
+			if _, err = s.recorder.Write(data); err != nil {
+				log.Infof("record session failed: %v", err)
+				s.close(err)
+				return
+			}
+		}
+		s.broadcast(msg, data)
+	}
+}
+
+// update track the framebuffer size, the desktop name and the cursor,
+// so that peers joining later get the current state
+func (s *session) update(msg rfb.Message) {
+	fu, ok := msg.(*rfb.FramebufferUpdate)
+	if !ok {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	for i, r := range fu.Rects {
+		switch r.Encoding {
+		case rfb.EncodingDesktopSize, rfb.EncodingExtendedDesktopSize:
+			s.serverInit.Width, s.serverInit.Height = r.Width, r.Height
+		case rfb.EncodingDesktopName:
+			// the payload is the length prefixed name
+			s.serverInit.Name = string(r.Data[4:])
+		case rfb.EncodingCursor, rfb.EncodingXCursor:
+			s.cursor = &fu.Rects[i]
+		}
+	}
+}
+
+// broadcast queue a server message for every peer,
+// cut text passes the clipboard policy and the filters of each peer
+func (s *session) broadcast(msg rfb.Message, data []byte) {
+	s.l.Lock()
+	peers := append([]*peer(nil), s.peers...)
+	s.l.Unlock()
+	cutText, isCutText := msg.(*rfb.ServerCutText)
+	for _, p := range peers {
+		if !isCutText {
+			p.send(data, s.key != "")
+			continue
+		}
+		text, ok := p.filterClipboard(false, cutText.Text, cutText.Extended)
+		if !ok {
+			continue
+		}
+		p.send((&rfb.ServerCutText{Text: text, Extended: cutText.Extended}).Bytes(), s.key != "")
+	}
+}
+
+// add the peer to the session, it returns false if the session has ended
+func (s *session) add(p *peer) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.closed {
+		return false
+	}
+	s.peers = append(s.peers, p)
+	return true
+}
+
+// remove the peer from the session, the session ends with its last peer
+func (s *session) remove(p *peer) {
+	s.l.Lock()
+	for i, peer := range s.peers {
+		if peer == p {
+			s.peers = append(s.peers[:i], s.peers[i+1:]...)
+			break
+		}
+	}
+	last := len(s.peers) == 0
+	s.l.Unlock()
+	if last {
+		s.close(nil)
+		return
+	}
+	if s.key != "" {
+		// the encodings p did not support can be used again
+		if err := s.updateEncodings(); err != nil {
+			log.Infof("update the encodings of vnc backend(%v) failed: %v", s.target.RemoteAddr(), err)
+		}
+	}
+}
+
+// close end the session for reason, which is reported to all its peers
+func (s *session) close(reason error) {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return
+	}
+	s.closed = true
+	peers := s.peers
+	s.l.Unlock()
+
+	s.target.Close()
+	for _, p := range peers {
+		p.closeWith(reason)
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// join send the current state to a peer which joined after the handshake,
+// the peer has not been added yet, so nothing else is queued for it
+func (s *session) join(p *peer) bool {
+	s.l.Lock()
+	cursor := s.cursor
+	s.l.Unlock()
+	if cursor != nil {
+		p.queue <- (&rfb.FramebufferUpdate{Rects: []rfb.Rectangle{*cursor}}).Bytes()
+	}
+	// Raw only until the peer tells which encodings it supports
+	p.encodings = []int32{}
+	if !s.add(p) {
+		return false
+	}
+	if err := s.updateEncodings(); err != nil {
+		log.Infof("update the encodings of vnc backend(%v) failed: %v", s.target.RemoteAddr(), err)
+	}
+	// a full refresh for the new peer, the other peers get it as well
+	si := s.currentServerInit()
+	s.write((&rfb.FramebufferUpdateRequest{Width: si.Width, Height: si.Height}).Bytes())
+	return true
+}
+
+// currentServerInit returns the ServerInit for a peer joining now
+func (s *session) currentServerInit() *rfb.ServerInit {
+	s.l.Lock()
+	defer s.l.Unlock()
+	si := s.serverInit
+	si.PixelFormat = s.reader.PixelFormat()
+	return &si
+}
+
+// forward write a client message of peer p to the backend, applying the session policies.
+// In a shared session the pixel format is set by the first peer while it is alone,
+// a peer asking for another pixel format once the session is shared is disconnected
+// with ErrIncompatibleClient, since every peer receives the same updates.
+// The encodings of a shared session are the ones all its peers support,
+// without the encodings whose decoder state a joining peer cannot know.
+func (s *session) forward(p *peer, msg rfb.Message) error {
+	switch m := msg.(type) {
+	case *rfb.SetPixelFormat:
+		if s.key == "" {
+			break
+		}
+		s.l.Lock()
+		alone := len(s.peers) <= 1
+		s.l.Unlock()
+		if alone {
+			break
+		}
+		if pf := s.reader.PixelFormat(); m.PixelFormat != pf {
+			err := classify(ErrIncompatibleClient, fmt.Errorf("pixel format %+v, the shared session uses %+v", m.PixelFormat, pf))
+			p.closeWith(err)
+			return err
+		}
+		return nil
+	case *rfb.SetEncodings:
+		encodings := make([]int32, 0, len(m.Encodings))
+		for _, e := range m.Encodings {
+			if rfb.IsSupported(e) && (s.key == "" || isStateless(e)) {
+				encodings = append(encodings, e)
+			}
+		}
+		if s.key != "" {
+			s.l.Lock()
+			p.encodings = encodings
+			s.l.Unlock()
+			return s.updateEncodings()
+		}
+		msg = &rfb.SetEncodings{Encodings: encodings}
+	case *rfb.ClientCutText:
+		if !s.controls(p) {
+			return nil
+		}
+		if m.Dropped > 0 {
+			p.dropCutText(m.Dropped)
+			return nil
+		}
+		text, ok := p.filterClipboard(true, m.Text, m.Extended)
+		if !ok {
+			return nil
+		}
+		msg = &rfb.ClientCutText{Text: text, Extended: m.Extended}
+	default:
+		if isInput(msg) && !s.controls(p) {
+			return nil
+		}
+	}
+	p.auditInput(msg)
+	data := msg.Bytes()
+	if s.recorder != nil {
+		if err := s.recorder.WriteInput(data); err != nil {
+			s.close(err)
+			return err
+		}
+	}
+	if err := s.write(data); err != nil {
+		return err
+	}
+	if m, ok := msg.(*rfb.SetPixelFormat); ok {
+		// only once it is written, the updates the server started before still use the old format
+		s.reader.SetPixelFormat(m.PixelFormat)
+		if s.recorder != nil {
+			s.recorder.SetPixelFormat(m.PixelFormat)
+		}
+	}
+	return nil
+}
+
+// controls reports whether the input of p is forwarded
+func (s *session) controls(p *peer) bool {
+	if p.t.ReadOnly {
+		return false
+	}
+	if s.t.Input != InputOwner {
+		return true
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.peers) > 0 && s.peers[0] == p
+}
+
+// inject write the key events of an admin with a single write,
+// so that the messages of the peers are not interleaved with them
+func (s *session) inject(events []*rfb.KeyEvent) error {
+	var data []byte
+	for _, e := range events {
+		data = append(data, e.Bytes()...)
+	}
+	if s.recorder != nil {
+		if err := s.recorder.WriteInput(data); err != nil {
+			s.close(err)
+			return err
+		}
+	}
+	return s.write(data)
+}
+
+// updateEncodings send the encodings of a shared session to the backend when they changed:
+// the encodings of its first peer which all the other peers support as well.
+// The first peer is not taken into account before it sends SetEncodings,
+// a joining peer supports only Raw until then.
+func (s *session) updateEncodings() error {
+	// the encodings are computed and sent in the same order
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	s.l.Lock()
+	encodings := commonEncodings(s.peers)
+	changed := encodings != nil && !sameEncodings(encodings, s.encodings)
+	if changed {
+		s.encodings = encodings
+	}
+	s.l.Unlock()
+	if !changed {
+		return nil
+	}
+	data := (&rfb.SetEncodings{Encodings: encodings}).Bytes()
+	if s.recorder != nil {
+		if err := s.recorder.WriteInput(data); err != nil {
+			s.close(err)
+			return err
+		}
+	}
+	_, err := s.target.Write(data)
+	return err
+}
+
+// commonEncodings returns the encodings all the peers with known encodings support,
+// in the order of the first of them, or nil if the encodings of no peer are known
+func commonEncodings(peers []*peer) []int32 {
+	var common []int32
+	for _, p := range peers {
+		if p.encodings == nil {
+			continue
+		}
+		if common == nil {
+			common = append([]int32{}, p.encodings...)
+			continue
+		}
+		kept := common[:0]
+		for _, e := range common {
+			for _, pe := range p.encodings {
+				if e == pe {
+					kept = append(kept, e)
+					break
+				}
+			}
+		}
+		common = kept
+	}
+	return common
+}
+
+func sameEncodings(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *session) write(data []byte) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	_, err := s.target.Write(data)
+	return err
+}
+
+// isStateless reports whether a peer joining a shared session can decode the encoding,
+// the zlib based encodings keep a compression state since the start of the connection
+// and fences and continuous updates are negotiated per client
+func isStateless(encoding int32) bool {
+	switch encoding {
+	case rfb.EncodingZlib, rfb.EncodingTight, rfb.EncodingZRLE,
+		rfb.EncodingFence, rfb.EncodingContinuousUpdates:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/rfb"
+)
+
+// pf8 is a pixel format other than testPixelFormat
+var pf8 = rfb.PixelFormat{BPP: 8, Depth: 8, TrueColour: true, RedMax: 7, GreenMax: 7, BlueMax: 3, GreenShift: 3, BlueShift: 6}
+
+// expectMessage fails unless the next client message the backend receives is want
+func expectMessage(t *testing.T, r *rfb.ClientReader, c *backendConn, want rfb.Message) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("read the client message: %v", err)
+	}
+	if !bytes.Equal(msg.Bytes(), want.Bytes()) {
+		t.Fatalf("the backend received %x, want %x", msg.Bytes(), want.Bytes())
+	}
+}
+
+func TestSetPixelFormatOutstandingRequest(t *testing.T) {
+	backend := startBackend(t, false)
+	defer backend.close()
+	_, url, stop := serveWS(t, &Config{TokenHandler: func(r *http.Request) (*Target, error) {
+		return &Target{Addr: backend.addr()}, nil
+	}})
+	defer stop()
+
+	c := connectWS(t, url)
+	defer c.Close()
+	conn := backend.conn(t)
+	r := rfb.NewClientReader(conn)
+
+	request := &rfb.FramebufferUpdateRequest{Incremental: true, Width: 64, Height: 48}
+	c.write(t, request.Bytes())
+	expectMessage(t, r, conn, request)
+	setPixelFormat := &rfb.SetPixelFormat{PixelFormat: pf8}
+	c.write(t, setPixelFormat.Bytes())
+	expectMessage(t, r, conn, setPixelFormat)
+
+	// the update of the outstanding request is sent in the new format
+	update := (&rfb.FramebufferUpdate{Rects: []rfb.Rectangle{{Width: 2, Height: 1, Encoding: rfb.EncodingRaw, Data: []byte{1, 2}}}}).Bytes()
+	want := append(update, rfb.BellMsg)
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(t, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("the client received %x, want %x", got, want)
+	}
+}
+
+// startShared open a shared session of a new backend through a new proxy with its first client
+func startShared(t *testing.T) (*testBackend, string, func(), *wsClient, *backendConn) {
+	t.Helper()
+	backend := startBackend(t, false)
+	_, url, stop := serveWS(t, &Config{TokenHandler: func(r *http.Request) (*Target, error) {
+		return &Target{Addr: backend.addr(), Shared: true}, nil
+	}})
+	first := connectWS(t, url)
+	return backend, url, func() {
+		first.Close()
+		stop()
+		backend.close()
+	}, first, backend.conn(t)
+}
+
+func TestSharedSessionFanOut(t *testing.T) {
+	backend, url, stop, first, conn := startShared(t)
+	defer stop()
+	r := rfb.NewClientReader(conn)
+	// the first client picks the pixel format while it is alone
+	setPixelFormat := &rfb.SetPixelFormat{PixelFormat: pf8}
+	first.write(t, setPixelFormat.Bytes())
+	expectMessage(t, r, conn, setPixelFormat)
+
+	joiner := dialWS(t, url)
+	defer joiner.Close()
+	joiner.startHandshake(t)
+	joiner.acceptNone(t)
+	if serverInit := joiner.initialize(t, false); serverInit.PixelFormat != pf8 {
+		t.Fatalf("the joining client got the pixel format %+v, want the one of the first client %+v", serverInit.PixelFormat, pf8)
+	}
+	backend.noConn(t)
+	// the full refresh of the joining client, the backend uses Raw already
+	expectMessage(t, r, conn, &rfb.FramebufferUpdateRequest{Width: 64, Height: 48})
+
+	update := (&rfb.FramebufferUpdate{Rects: []rfb.Rectangle{{Width: 2, Height: 1, Encoding: rfb.EncodingRaw, Data: []byte{1, 2}}}}).Bytes()
+	want := append(update, rfb.BellMsg)
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*wsClient{first, joiner} {
+		if got := c.read(t, len(want)); !bytes.Equal(got, want) {
+			t.Fatalf("the client received %x, want %x", got, want)
+		}
+	}
+}
+
+func TestSharedSessionEncodings(t *testing.T) {
+	_, url, stop, first, conn := startShared(t)
+	defer stop()
+	r := rfb.NewClientReader(conn)
+	// the decoders of a joining client miss the state of Tight, ZRLE and Zlib
+	first.write(t, (&rfb.SetEncodings{Encodings: []int32{rfb.EncodingTight, rfb.EncodingZRLE, rfb.EncodingCoRRE, rfb.EncodingHextile,
+		rfb.EncodingZlib, rfb.EncodingRaw, rfb.EncodingCursor, rfb.EncodingFence}}).Bytes())
+	firstEncodings := &rfb.SetEncodings{Encodings: []int32{rfb.EncodingCoRRE, rfb.EncodingHextile, rfb.EncodingRaw, rfb.EncodingCursor}}
+	expectMessage(t, r, conn, firstEncodings)
+
+	joiner := connectWS(t, url)
+	defer joiner.Close()
+	// Raw only until the joining client sends its encodings
+	expectMessage(t, r, conn, &rfb.SetEncodings{Encodings: []int32{}})
+	expectMessage(t, r, conn, &rfb.FramebufferUpdateRequest{Width: 64, Height: 48})
+	// the encodings both clients support in the order of the first client, e.g. noVNC does not support CoRRE
+	joiner.write(t, (&rfb.SetEncodings{Encodings: []int32{rfb.EncodingTight, rfb.EncodingCursor, rfb.EncodingHextile, rfb.EncodingRaw}}).Bytes())
+	expectMessage(t, r, conn, &rfb.SetEncodings{Encodings: []int32{rfb.EncodingHextile, rfb.EncodingRaw, rfb.EncodingCursor}})
+	// unchanged encodings are not sent again
+	joiner.write(t, (&rfb.SetEncodings{Encodings: []int32{rfb.EncodingRaw, rfb.EncodingHextile, rfb.EncodingCursor}}).Bytes())
+	keyEvent := &rfb.KeyEvent{Down: true, Key: 'a'}
+	joiner.write(t, keyEvent.Bytes())
+	expectMessage(t, r, conn, keyEvent)
+
+	// the encodings of the first client are used again once the joining client left
+	joiner.Close()
+	expectMessage(t, r, conn, firstEncodings)
+}
+
+func TestSharedSessionPixelFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		pf   rfb.PixelFormat
+		// want is the close code of the joining client, 0 when it stays connected
+		want int
+	}{
+		{"same pixel format", testPixelFormat, 0},
+		{"other pixel format", pf8, CloseIncompatibleClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url, stop, first, conn := startShared(t)
+			defer stop()
+			r := rfb.NewClientReader(conn)
+
+			joiner := connectWS(t, url)
+			defer joiner.Close()
+			expectMessage(t, r, conn, &rfb.FramebufferUpdateRequest{Width: 64, Height: 48})
+			// the pixel format is never changed once the session is shared
+			joiner.write(t, (&rfb.SetPixelFormat{PixelFormat: tt.pf}).Bytes())
+			if tt.want != 0 {
+				if code := joiner.closeCode(t); code != tt.want {
+					t.Fatalf("close code = %d, want %d", code, tt.want)
+				}
+			} else {
+				keyEvent := &rfb.KeyEvent{Down: true, Key: 'a'}
+				joiner.write(t, keyEvent.Bytes())
+				expectMessage(t, r, conn, keyEvent)
+			}
+
+			// the first client keeps viewing the session
+			if _, err := conn.Write([]byte{rfb.BellMsg}); err != nil {
+				t.Fatal(err)
+			}
+			if b := first.read(t, 1); b[0] != rfb.BellMsg {
+				t.Fatalf("the first client received message type %d, want the bell", b[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/ssh"
+)
+
+// Target describes the vnc backend a websocket session is proxied to,
+// as resolved by the TokenHandler
+type Target struct {
+	// User is the identity of the websocket client reported in the audit events
+	User string
+	// Addr is the vnc backend server address, e.g. 127.0.0.1:5900
+	Addr string
+	// Network is the network of Addr passed to Config.Dialer, tcp when it is empty,
+	// e.g. unix with Addr set to the path of the socket
+	Network string
+	// EgressProxy is the SOCKS5 or HTTP CONNECT proxy Addr is dialed through, see NewEgressDialer,
+	// it overrides Config.EgressProxy and EgressDirect dials without a proxy
+	EgressProxy string
+	// SSH is the host Addr is dialed from through an ssh tunnel, e.g. for backends listening on localhost,
+	// the ssh clients are shared by the sessions tunneling through the same host with the same credentials
+	SSH *ssh.SSHClientConfig
+	// Reverse is the id of a vnc server connected to Config.ReverseListener,
+	// its waiting connection is used instead of dialing Addr
+	Reverse string
+	// Repeater is the ID:nnnn of a vnc server connected to Config.Repeater without the ID: prefix,
+	// the client joins the server as its viewer instead of dialing Addr
+	Repeater string
+	// Username is used for VeNCrypt Plain authentication
+	Username string
+	// Password is used by the proxy itself to complete VNC Authentication
+	// or VeNCrypt VNC/Plain authentication against the backend,
+	// it is never sent to the websocket client
+	Password string
+	// TLS configures the verification of VeNCrypt X509 backends,
+	// the TLS settings of the app config are used when it is nil.
+	// VeNCrypt is preferred to VNC Authentication and None when either is set.
+	TLS *TLSConfig
+	// ReadOnly makes a view-only session, the proxy drops keyboard, pointer,
+	// clipboard and other input messages of the client, and asks the backend to share the desktop
+	ReadOnly bool
+	// RecordPath is the FBS file the session is recorded to, see FBSHeader,
+	// the session is not recorded when it is empty
+	RecordPath string
+	// RecordInput also records the client messages to RecordPath+InputSuffix
+	RecordInput bool
+	// Shared lets the websocket clients of the same backend (Addr and SSH host, Reverse or Repeater id)
+	// view a single backend connection, the settings of the Target of the first client apply to the whole session.
+	// The clients join without authentication only when the proxy authenticated to the backend,
+	// if the first client answered the VNC Authentication of the backend itself,
+	// the other clients open their own backend connection and must answer it as well.
+	// The session uses the encodings all its clients support, the pixel format is set by the first client
+	// while it is alone and a client asking for another one is closed with CloseIncompatibleClient
+	Shared bool
+	// Input decides whose input a shared session forwards
+	Input InputPolicy
+	// Clipboard decides in which directions the clipboard is transferred, both by default
+	Clipboard ClipboardPolicy
+	// ClipboardMaxSize drops cut text larger than this many bytes, 0 means no limit.
+	// The cut text of the client is never larger than rfb.MaxClientCutTextLength,
+	// longer payloads are skipped without being buffered.
+	ClipboardMaxSize int
+	// ClipboardFilters are applied to the cut text of the session after Config.ClipboardFilters
+	ClipboardFilters []ClipboardFilter
+	// IdleTimeout and MaxSessionDuration override the limits of the Config for this session,
+	// 0 keeps the Config value and a negative value disables the limit
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+}
+
+// backend returns the address identifying the backend of t,
+// ssh:<host>/<addr> through an ssh host, reverse:<id> for a server in reverse mode
+// and repeater:<id> for a server connected to the repeater
+func (t *Target) backend() string {
+	switch {
+	case t.SSH != nil:
+		return "ssh:" + t.SSH.HostAddr + "/" + t.Addr
+	case t.Reverse != "":
+		return "reverse:" + t.Reverse
+	case t.Repeater != "":
+		return "repeater:" + t.Repeater
+	}
+	return t.Addr
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+
+	"github.com/lwydyby/go-vnc-proxy/conf"
+	"github.com/pkg/errors"
+)
+
+// TLSConfig describes how the proxy verifies a VeNCrypt X509 backend
+type TLSConfig struct {
+	// CACerts is the PEM CA bundle file used to verify the server certificate,
+	// the system roots are used when it is empty
+	CACerts string
+	// Cert and Key are the PEM client certificate and key files,
+	// only needed when the server asks for a client certificate
+	Cert string
+	Key  string
+	// ServerName is the name expected in the server certificate,
+	// defaults to the host of Target.Addr
+	ServerName string
+	// InsecureSkipVerify disables the server certificate and hostname verification
+	InsecureSkipVerify bool
+}
+
+// tlsConfig returns the TLS settings of the target,
+// falling back to the global TLSCert/TLSKey/TLSCaCerts of the app config
+func (t *Target) tlsConfig() *TLSConfig {
+	if t.TLS != nil {
+		return t.TLS
+	}
+	return &TLSConfig{
+		CACerts: conf.Conf.AppInfo.TLSCaCerts,
+		Cert:    conf.Conf.AppInfo.TLSCert,
+		Key:     conf.Conf.AppInfo.TLSKey,
+	}
+}
+
+// hasX509Config tells whether the target or the app config has settings for VeNCrypt X509 backends
+func (t *Target) hasX509Config() bool {
+	return t.TLS != nil || conf.Conf.AppInfo.TLSCaCerts != "" || conf.Conf.AppInfo.TLSCert != ""
+}
+
+// x509Config build the tls.Config used for the VeNCrypt X509 sub-types of the target
+func x509Config(t *Target) (*tls.Config, error) {
+	c := t.tlsConfig()
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get server name from vnc backend addr %v", t.Addr)
+		}
+		config.ServerName = host
+	}
+	if c.CACerts != "" {
+		certBytes, err := ioutil.ReadFile(c.CACerts)
+		if err != nil {
+			return nil, errors.Wrap(err, "read vnc backend CA certs failed")
+		}
+		rootCertPool := x509.NewCertPool()
+		if !rootCertPool.AppendCertsFromPEM(certBytes) {
+			return nil, errors.Errorf("no certificate found in vnc backend CA certs %v", c.CACerts)
+		}
+		config.RootCAs = rootCertPool
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "load vnc client certificate failed")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lwydyby/go-vnc-proxy/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshIdleTimeout is how long an ssh client without tunnels is kept for the next session to its host
+const sshIdleTimeout = time.Minute
+
+// sshClients are shared by the sessions of all proxies tunneling through the same host with the same credentials
+var sshClients = &sshPool{clients: make(map[ssh.SSHClientConfig]*sshClient)}
+
+type sshPool struct {
+	l       sync.Mutex
+	clients map[ssh.SSHClientConfig]*sshClient
+}
+
+type sshClient struct {
+	// ready is closed once client or err is set
+	ready  chan struct{}
+	client *gossh.Client
+	err    error
+	// refs counts the users of the client, idle closes it when it stays unused
+	refs int
+	idle *time.Timer
+}
+
+// dialSSH open a tunnel to addr through the ssh host of conf, network is tcp or unix
+func dialSSH(conf *ssh.SSHClientConfig, network, addr string) (net.Conn, error) {
+	key := *conf
+	if key.Timeout == 0 {
+		key.Timeout = 5 * time.Second
+	}
+	c, err := sshClients.get(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ssh to %v failed", key.HostAddr)
+	}
+	conn, err := c.client.Dial(network, addr)
+	if err != nil {
+		sshClients.release(key, c)
+		return nil, errors.Wrapf(err, "tunnel to %v through ssh %v failed", addr, key.HostAddr)
+	}
+	return &tunnelConn{Conn: conn, release: func() { sshClients.release(key, c) }}, nil
+}
+
+// get returns the client of key with a reference taken, connecting it if there is none
+func (p *sshPool) get(key ssh.SSHClientConfig) (*sshClient, error) {
+	p.l.Lock()
+	c, ok := p.clients[key]
+	if !ok {
+		c = &sshClient{ready: make(chan struct{})}
+		p.clients[key] = c
+	}
+	c.refs++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	p.l.Unlock()
+
+	if !ok {
+		c.client, c.err = ssh.NewSSHClient(&key)
+		if c.err == nil {
+			go p.watch(key, c)
+		}
+		close(c.ready)
+	}
+	<-c.ready
+	if c.err != nil {
+		p.l.Lock()
+		c.refs--
+		if p.clients[key] == c {
+			delete(p.clients, key)
+		}
+		p.l.Unlock()
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// release drop a reference to c, the client is closed after sshIdleTimeout without references
+func (p *sshPool) release(key ssh.SSHClientConfig, c *sshClient) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	c.refs--
+	if c.refs > 0 || p.clients[key] != c {
+		return
+	}
+	c.idle = time.AfterFunc(sshIdleTimeout, func() {
+		p.l.Lock()
+		unused := c.refs == 0 && p.clients[key] == c
+		if unused {
+			delete(p.clients, key)
+		}
+		p.l.Unlock()
+		if unused {
+			c.client.Close()
+		}
+	})
+}
+
+// watch remove c from the pool once its connection ended
+func (p *sshPool) watch(key ssh.SSHClientConfig, c *sshClient) {
+	c.client.Wait()
+	p.l.Lock()
+	if p.clients[key] == c {
+		delete(p.clients, key)
+	}
+	p.l.Unlock()
+}
+
+// tunnelConn is a connection through an ssh client. ssh channels do not support deadlines,
+// an expired deadline closes the connection instead, which is enough for the handshake timeout.
+type tunnelConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+
+	l     sync.Mutex
+	timer *time.Timer
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.SetDeadline(time.Time{})
+		c.release()
+	})
+	return err
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.Conn.Close() })
+	}
+	return nil
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
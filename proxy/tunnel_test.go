@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lwydyby/go-vnc-proxy/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshHost is an ssh server accepting the password "secret" and forwarding direct-tcpip channels
+type sshHost struct {
+	addr    string
+	hostKey string
+	// conns counts the ssh connections
+	conns int32
+}
+
+func newHostKey(t *testing.T) gossh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startSSHHost(t *testing.T) (*sshHost, func()) {
+	signer := newHostKey(t)
+	config := &gossh.ServerConfig{
+		PasswordCallback: func(c gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sshHost{addr: l.Addr().String(), hostKey: string(gossh.MarshalAuthorizedKey(signer.PublicKey()))}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h.serve(c, config)
+		}
+	}()
+	return h, func() { l.Close() }
+}
+
+func (h *sshHost) serve(c net.Conn, config *gossh.ServerConfig) {
+	conn, chans, reqs, err := gossh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	atomic.AddInt32(&h.conns, 1)
+	go gossh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(gossh.UnknownChannelType, nc.ChannelType())
+			continue
+		}
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := gossh.Unmarshal(nc.ExtraData(), &target); err != nil {
+			nc.Reject(gossh.Prohibited, err.Error())
+			continue
+		}
+		b, err := net.Dial("tcp", fmt.Sprintf("%v:%v", target.Host, target.Port))
+		if err != nil {
+			nc.Reject(gossh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			b.Close()
+			continue
+		}
+		go gossh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, b)
+			ch.Close()
+		}()
+		go func() {
+			io.Copy(b, ch)
+			b.Close()
+		}()
+	}
+}
+
+// echoServer echoes what its clients send
+func echoServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func expectEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	if _, err := c.Write([]byte("RFB 003.008\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	expectRead(t, c, "RFB 003.008\n")
+}
+
+func TestDialSSH(t *testing.T) {
+	host, stop := startSSHHost(t)
+	defer stop()
+	backend, stopBackend := echoServer(t)
+	defer stopBackend()
+	otherKey := string(gossh.MarshalAuthorizedKey(newHostKey(t).PublicKey()))
+
+	tests := []struct {
+		name    string
+		conf    ssh.SSHClientConfig
+		addr    string
+		wantErr bool
+	}{
+		{"host key", ssh.SSHClientConfig{HostKey: host.hostKey, Password: "secret"}, backend, false},
+		{"insecure without host key", ssh.SSHClientConfig{InsecureIgnoreHostKey: true, Password: "secret"}, backend, false},
+		{"other host key", ssh.SSHClientConfig{HostKey: otherKey, Password: "secret"}, backend, true},
+		{"wrong password", ssh.SSHClientConfig{HostKey: host.hostKey, Password: "wrong"}, backend, true},
+		{"backend refused", ssh.SSHClientConfig{HostKey: host.hostKey, Password: "secret"}, "127.0.0.1:1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.AuthModel = ssh.PASSWORD
+			conf.HostAddr = host.addr
+			conf.User = "vnc"
+			c, err := dialSSH(&conf, "tcp", tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					c.Close()
+					t.Fatal("dialSSH() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialSSH() error = %v", err)
+			}
+			defer c.Close()
+			expectEcho(t, c)
+		})
+	}
+}
+
+func TestDialSSHNoHostKey(t *testing.T) {
+	_, err := dialSSH(&ssh.SSHClientConfig{AuthModel: ssh.PASSWORD, HostAddr: "127.0.0.1:22"}, "tcp", "127.0.0.1:5900")
+	if !errors.Is(err, ssh.ErrNoHostKey) {
+		t.Fatalf("dialSSH() error = %v, want %v", err, ssh.ErrNoHostKey)
+	}
+}
+
+func TestDialSSHSharesClient(t *testing.T) {
+	host, stop := startSSHHost(t)
+	defer stop()
+	backend, stopBackend := echoServer(t)
+	defer stopBackend()
+
+	conf := &ssh.SSHClientConfig{AuthModel: ssh.PASSWORD, HostAddr: host.addr, User: "vnc", Password: "secret", HostKey: host.hostKey}
+	first, err := dialSSH(conf, "tcp", backend)
+	if err != nil {
+		t.Fatalf("dialSSH() error = %v", err)
+	}
+	second, err := dialSSH(conf, "tcp", backend)
+	if err != nil {
+		t.Fatalf("dialSSH() error = %v", err)
+	}
+	// the first tunnel closing keeps the client of the second
+	first.Close()
+	expectEcho(t, second)
+	second.Close()
+	if n := atomic.LoadInt32(&host.conns); n != 1 {
+		t.Fatalf("the tunnels used %d ssh connections, want 1", n)
+	}
+}
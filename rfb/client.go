@@ -0,0 +1,347 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// SetPixelFormat sets the format of the pixel values the server sends
+type SetPixelFormat struct {
+	PixelFormat PixelFormat
+}
+
+func (m *SetPixelFormat) Type() uint8 { return SetPixelFormatMsg }
+
+func (m *SetPixelFormat) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.pad(3)
+	w.write(m.PixelFormat.bytes())
+	return w.b
+}
+
+// SetEncodings lists the encodings and pseudo-encodings the client supports, most preferred first
+type SetEncodings struct {
+	Encodings []int32
+}
+
+func (m *SetEncodings) Type() uint8 { return SetEncodingsMsg }
+
+func (m *SetEncodings) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.pad(1)
+	w.u16(uint16(len(m.Encodings)))
+	for _, e := range m.Encodings {
+		w.u32(uint32(e))
+	}
+	return w.b
+}
+
+// FramebufferUpdateRequest asks for an update of a framebuffer area
+type FramebufferUpdateRequest struct {
+	Incremental         bool
+	X, Y, Width, Height uint16
+}
+
+func (m *FramebufferUpdateRequest) Type() uint8 { return FramebufferUpdateRequestMsg }
+
+func (m *FramebufferUpdateRequest) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.u8(bool2byte(m.Incremental))
+	w.u16(m.X)
+	w.u16(m.Y)
+	w.u16(m.Width)
+	w.u16(m.Height)
+	return w.b
+}
+
+// KeyEvent presses or releases the key identified by an X keysym
+type KeyEvent struct {
+	Down bool
+	Key  uint32
+}
+
+func (m *KeyEvent) Type() uint8 { return KeyEventMsg }
+
+func (m *KeyEvent) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.u8(bool2byte(m.Down))
+	w.pad(2)
+	w.u32(m.Key)
+	return w.b
+}
+
+// PointerEvent moves the pointer, ButtonMask holds the state of buttons 1 to 8
+type PointerEvent struct {
+	ButtonMask uint8
+	X, Y       uint16
+}
+
+func (m *PointerEvent) Type() uint8 { return PointerEventMsg }
+
+func (m *PointerEvent) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.u8(m.ButtonMask)
+	w.u16(m.X)
+	w.u16(m.Y)
+	return w.b
+}
+
+// ClientCutText sends the client clipboard as Latin-1 text.
+// With the Extended Clipboard pseudo-encoding the length is negative
+// and Text holds the extended clipboard payload instead.
+type ClientCutText struct {
+	Text     []byte
+	Extended bool
+	// Dropped is the length of a payload longer than ClientReader.MaxCutText,
+	// which was skipped without being read into Text
+	Dropped uint32
+}
+
+func (m *ClientCutText) Type() uint8 { return ClientCutTextMsg }
+
+func (m *ClientCutText) Bytes() []byte {
+	return cutTextBytes(m.Type(), m.Text, m.Extended)
+}
+
+// EnableContinuousUpdates enables or disables continuous updates of a framebuffer area
+type EnableContinuousUpdates struct {
+	Enable              bool
+	X, Y, Width, Height uint16
+}
+
+func (m *EnableContinuousUpdates) Type() uint8 { return EnableContinuousUpdatesMsg }
+
+func (m *EnableContinuousUpdates) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.u8(bool2byte(m.Enable))
+	w.u16(m.X)
+	w.u16(m.Y)
+	w.u16(m.Width)
+	w.u16(m.Height)
+	return w.b
+}
+
+// Screen is a screen of the ExtendedDesktopSize layout
+type Screen struct {
+	ID                  uint32
+	X, Y, Width, Height uint16
+	Flags               uint32
+}
+
+// SetDesktopSize asks the server to change the framebuffer size and screen layout
+type SetDesktopSize struct {
+	Width, Height uint16
+	Screens       []Screen
+}
+
+func (m *SetDesktopSize) Type() uint8 { return SetDesktopSizeMsg }
+
+func (m *SetDesktopSize) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.pad(1)
+	w.u16(m.Width)
+	w.u16(m.Height)
+	w.u8(uint8(len(m.Screens)))
+	w.pad(1)
+	writeScreens(w, m.Screens)
+	return w.b
+}
+
+// QEMUExtendedKeyEvent is a KeyEvent carrying the XT scan code of the key as well
+type QEMUExtendedKeyEvent struct {
+	Down    bool
+	Key     uint32
+	Keycode uint32
+}
+
+func (m *QEMUExtendedKeyEvent) Type() uint8 { return QEMUClientMsg }
+
+func (m *QEMUExtendedKeyEvent) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.u8(0)
+	w.u16(uint16(bool2byte(m.Down)))
+	w.u32(m.Key)
+	w.u32(m.Keycode)
+	return w.b
+}
+
+// RawMessage is a message the parser frames without interpreting,
+// Data holds everything after the message-type byte
+type RawMessage struct {
+	MsgType uint8
+	Data    []byte
+}
+
+func (m *RawMessage) Type() uint8 { return m.MsgType }
+
+func (m *RawMessage) Bytes() []byte {
+	return append([]byte{m.MsgType}, m.Data...)
+}
+
+// ClientReader reads client to server messages from a stream
+type ClientReader struct {
+	r io.Reader
+	// MaxCutText limits the payload of ClientCutText, a longer payload is skipped
+	// and reported with ClientCutText.Dropped. Defaults to MaxClientCutTextLength.
+	MaxCutText int
+}
+
+func NewClientReader(r io.Reader) *ClientReader {
+	return &ClientReader{r: r, MaxCutText: MaxClientCutTextLength}
+}
+
+// ReadMessage reads the next message, it returns io.EOF if the stream ends between two messages
+func (c *ClientReader) ReadMessage() (Message, error) {
+	s := &stream{r: c.r}
+	t := s.u8()
+	if s.err != nil {
+		return nil, s.err
+	}
+	var m Message
+	switch t {
+	case SetPixelFormatMsg:
+		s.skip(3)
+		b := s.read(16)
+		if b != nil {
+			m = &SetPixelFormat{PixelFormat: parsePixelFormat(b)}
+		}
+	case SetEncodingsMsg:
+		s.skip(1)
+		n := int(s.u16())
+		b := s.read(4 * n)
+		encodings := make([]int32, 0, n)
+		for i := 0; i < len(b); i += 4 {
+			encodings = append(encodings, int32(binary.BigEndian.Uint32(b[i:])))
+		}
+		m = &SetEncodings{Encodings: encodings}
+	case FramebufferUpdateRequestMsg:
+		m = &FramebufferUpdateRequest{Incremental: s.u8() != 0, X: s.u16(), Y: s.u16(), Width: s.u16(), Height: s.u16()}
+	case KeyEventMsg:
+		down := s.u8() != 0
+		s.skip(2)
+		m = &KeyEvent{Down: down, Key: s.u32()}
+	case PointerEventMsg:
+		m = &PointerEvent{ButtonMask: s.u8(), X: s.u16(), Y: s.u16()}
+	case ClientCutTextMsg:
+		s.skip(3)
+		length, extended := cutTextLength(s)
+		if c.MaxCutText > 0 && length > uint64(c.MaxCutText) {
+			// the size is checked before anything is buffered
+			s.discard(length)
+			m = &ClientCutText{Extended: extended, Dropped: uint32(length)}
+		} else {
+			m = &ClientCutText{Text: s.payload(length), Extended: extended}
+		}
+	case EnableContinuousUpdatesMsg:
+		m = &EnableContinuousUpdates{Enable: s.u8() != 0, X: s.u16(), Y: s.u16(), Width: s.u16(), Height: s.u16()}
+	case ClientFenceMsg:
+		b := s.read(8)
+		if b != nil {
+			m = &RawMessage{MsgType: t, Data: append(b, s.read(int(b[7]))...)}
+		}
+	case ClientXvpMsg:
+		m = &RawMessage{MsgType: t, Data: s.read(3)}
+	case SetDesktopSizeMsg:
+		s.skip(1)
+		width, height := s.u16(), s.u16()
+		n := int(s.u8())
+		s.skip(1)
+		m = &SetDesktopSize{Width: width, Height: height, Screens: readScreens(s, n)}
+	case GiiMsg:
+		b := s.read(3)
+		if b != nil {
+			// the length is big endian if the high bit of the endian-and-sub-type byte is set
+			length := binary.LittleEndian.Uint16(b[1:])
+			if b[0]&0x80 != 0 {
+				length = binary.BigEndian.Uint16(b[1:])
+			}
+			m = &RawMessage{MsgType: t, Data: append(b, s.read(int(length))...)}
+		}
+	case QEMUClientMsg:
+		m = readQEMUClientMessage(s)
+	default:
+		return nil, &UnsupportedError{What: "client message", Value: int32(t)}
+	}
+	if s.err != nil {
+		if s.err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, s.err
+	}
+	return m, nil
+}
+
+func readQEMUClientMessage(s *stream) Message {
+	subType := s.u8()
+	switch subType {
+	case 0:
+		return &QEMUExtendedKeyEvent{Down: s.u16() != 0, Key: s.u32(), Keycode: s.u32()}
+	case 1:
+		// audio: operation 2 sets the sample format
+		op := s.read(2)
+		data := append([]byte{subType}, op...)
+		if op != nil && binary.BigEndian.Uint16(op) == 2 {
+			data = append(data, s.read(6)...)
+		}
+		return &RawMessage{MsgType: QEMUClientMsg, Data: data}
+	}
+	if s.err == nil {
+		s.err = &UnsupportedError{What: "client message", Value: int32(QEMUClientMsg)<<8 | int32(subType)}
+	}
+	return nil
+}
+
+func readCutText(s *stream) ([]byte, bool) {
+	s.skip(3)
+	length, extended := cutTextLength(s)
+	return s.payload(length), extended
+}
+
+// cutTextLength read the length of a cut text payload, a negative length marks an extended clipboard message
+func cutTextLength(s *stream) (uint64, bool) {
+	length := int32(s.u32())
+	if length < 0 {
+		return uint64(-int64(length)), true
+	}
+	return uint64(length), false
+}
+
+func cutTextBytes(t uint8, text []byte, extended bool) []byte {
+	w := &writer{}
+	w.u8(t)
+	w.pad(3)
+	if extended {
+		w.u32(uint32(-int32(len(text))))
+	} else {
+		w.u32(uint32(len(text)))
+	}
+	w.write(text)
+	return w.b
+}
+
+func readScreens(s *stream, n int) []Screen {
+	screens := make([]Screen, 0, n)
+	for i := 0; i < n && s.err == nil; i++ {
+		screens = append(screens, Screen{ID: s.u32(), X: s.u16(), Y: s.u16(), Width: s.u16(), Height: s.u16(), Flags: s.u32()})
+	}
+	return screens
+}
+
+func writeScreens(w *writer, screens []Screen) {
+	for _, sc := range screens {
+		w.u32(sc.ID)
+		w.u16(sc.X)
+		w.u16(sc.Y)
+		w.u16(sc.Width)
+		w.u16(sc.Height)
+		w.u32(sc.Flags)
+	}
+}
@@ -0,0 +1,133 @@
+package rfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var testPixelFormat = PixelFormat{
+	BPP: 32, Depth: 24, TrueColour: true,
+	RedMax: 255, GreenMax: 255, BlueMax: 255,
+	RedShift: 16, GreenShift: 8, BlueShift: 0,
+}
+
+func TestClientMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"SetPixelFormat", &SetPixelFormat{PixelFormat: testPixelFormat}},
+		{"SetEncodings", &SetEncodings{Encodings: []int32{EncodingTight, EncodingRaw, EncodingExtendedClipboard}}},
+		{"FramebufferUpdateRequest", &FramebufferUpdateRequest{Incremental: true, X: 1, Y: 2, Width: 3, Height: 4}},
+		{"KeyEvent", &KeyEvent{Down: true, Key: 0xff0d}},
+		{"PointerEvent", &PointerEvent{ButtonMask: 1, X: 5, Y: 6}},
+		{"ClientCutText", &ClientCutText{Text: []byte("hello")}},
+		{"extended ClientCutText", &ClientCutText{Text: []byte("extended"), Extended: true}},
+		{"EnableContinuousUpdates", &EnableContinuousUpdates{Enable: true, Width: 10, Height: 10}},
+		{"SetDesktopSize", &SetDesktopSize{Width: 100, Height: 200, Screens: []Screen{{ID: 1, Width: 100, Height: 200}}}},
+		{"QEMUExtendedKeyEvent", &QEMUExtendedKeyEvent{Down: true, Key: 0x61, Keycode: 30}},
+		{"ClientFence", &RawMessage{MsgType: ClientFenceMsg, Data: []byte{0, 0, 0, 0, 0, 0, 0, 2, 9, 9}}},
+		{"ClientXvp", &RawMessage{MsgType: ClientXvpMsg, Data: []byte{0, 1, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.msg.Bytes()
+			r := NewClientReader(bytes.NewReader(b))
+			got, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("ReadMessage() = %#v, want %#v", got, tt.msg)
+			}
+			if _, err = r.ReadMessage(); err != io.EOF {
+				t.Fatalf("ReadMessage() after the message error = %v, want io.EOF", err)
+			}
+
+			// every prefix of the message is truncated
+			for n := 1; n < len(b); n++ {
+				_, err := NewClientReader(bytes.NewReader(b[:n])).ReadMessage()
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("ReadMessage() of %d of %d bytes error = %v, want io.ErrUnexpectedEOF", n, len(b), err)
+				}
+			}
+		})
+	}
+}
+
+func TestClientMessagesMalformed(t *testing.T) {
+	tooLong := []byte{ClientCutTextMsg, 0, 0, 0}
+	tooLong = append(tooLong, u32(uint32(MaxPayloadLength)+1)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"unknown message type", []byte{99}, &UnsupportedError{What: "client message", Value: 99}},
+		{"unknown QEMU sub-type", []byte{QEMUClientMsg, 7}, &UnsupportedError{What: "client message", Value: int32(QEMUClientMsg)<<8 | 7}},
+		{"cut text above MaxPayloadLength", tooLong, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewClientReader(bytes.NewReader(tt.data))
+			r.MaxCutText = 0
+			_, err := r.ReadMessage()
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCutTextLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        *ClientCutText
+		maxCutText int
+		want       *ClientCutText
+	}{
+		{"below the limit", &ClientCutText{Text: []byte("abc")}, 4, &ClientCutText{Text: []byte("abc")}},
+		{"at the limit", &ClientCutText{Text: []byte("abcd")}, 4, &ClientCutText{Text: []byte("abcd")}},
+		{"above the limit", &ClientCutText{Text: []byte("abcde")}, 4, &ClientCutText{Dropped: 5}},
+		{"extended above the limit", &ClientCutText{Text: make([]byte, 10), Extended: true}, 4, &ClientCutText{Extended: true, Dropped: 10}},
+		{"no limit", &ClientCutText{Text: []byte("abcde")}, 0, &ClientCutText{Text: []byte("abcde")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the message after the cut text must still be framed
+			next := &KeyEvent{Down: true, Key: 'a'}
+			r := NewClientReader(bytes.NewReader(append(tt.msg.Bytes(), next.Bytes()...)))
+			r.MaxCutText = tt.maxCutText
+			got, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadMessage() = %#v, want %#v", got, tt.want)
+			}
+			got, err = r.ReadMessage()
+			if err != nil || !reflect.DeepEqual(got, next) {
+				t.Fatalf("ReadMessage() of the next message = %#v, %v, want %#v", got, err, next)
+			}
+		})
+	}
+}
+
+func TestClientCutTextLimitTruncated(t *testing.T) {
+	b := (&ClientCutText{Text: make([]byte, 100)}).Bytes()
+	r := NewClientReader(bytes.NewReader(b[:50]))
+	r.MaxCutText = 10
+	if _, err := r.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadMessage() error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
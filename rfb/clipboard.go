@@ -0,0 +1,164 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// extended clipboard formats
+const (
+	ClipboardText  uint32 = 1 << 0
+	ClipboardRTF   uint32 = 1 << 1
+	ClipboardHTML  uint32 = 1 << 2
+	ClipboardDIB   uint32 = 1 << 3
+	ClipboardFiles uint32 = 1 << 4
+)
+
+// extended clipboard actions
+const (
+	ClipboardCaps    uint32 = 1 << 24
+	ClipboardRequest uint32 = 1 << 25
+	ClipboardPeek    uint32 = 1 << 26
+	ClipboardNotify  uint32 = 1 << 27
+	ClipboardProvide uint32 = 1 << 28
+
+	clipboardFormats = 0xffff
+	clipboardActions = 0xff000000
+)
+
+var ErrMalformedClipboard = errors.New("rfb: malformed extended clipboard message")
+
+// ExtendedClipboard is the payload of a cut text message sent with the Extended Clipboard
+// pseudo-encoding. Its flags hold one action and the formats it is about.
+type ExtendedClipboard struct {
+	Flags uint32
+	// MaxSizes are the maximum sizes of the formats of a caps message, in the order of the format bits
+	MaxSizes []uint32
+	// Data holds the data of every format of a provide message, by format flag
+	Data map[uint32][]byte
+}
+
+// Action returns the action flag
+func (e *ExtendedClipboard) Action() uint32 {
+	return e.Flags & clipboardActions
+}
+
+// Formats returns the format flags
+func (e *ExtendedClipboard) Formats() uint32 {
+	return e.Flags & clipboardFormats
+}
+
+// Size returns the size of the data of a provide message
+func (e *ExtendedClipboard) Size() int {
+	size := 0
+	for _, data := range e.Data {
+		size += len(data)
+	}
+	return size
+}
+
+// Text returns the UTF-8 text of a provide message with the line endings converted to \n
+func (e *ExtendedClipboard) Text() (string, bool) {
+	data, ok := e.Data[ClipboardText]
+	if !ok {
+		return "", false
+	}
+	text := strings.TrimSuffix(string(data), "\x00")
+	return strings.Replace(text, "\r\n", "\n", -1), true
+}
+
+// SetText sets the text of a provide message, which is sent with \r\n line endings and null-terminated
+func (e *ExtendedClipboard) SetText(text string) {
+	if e.Data == nil {
+		e.Data = make(map[uint32][]byte)
+	}
+	text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	e.Data[ClipboardText] = append([]byte(text), 0)
+	e.Flags |= ClipboardText
+}
+
+// ParseExtendedClipboard parses the payload of an extended cut text message.
+// The data of a provide message is decompressed, up to MaxPayloadLength bytes.
+func ParseExtendedClipboard(payload []byte) (*ExtendedClipboard, error) {
+	return ParseExtendedClipboardLimit(payload, MaxPayloadLength)
+}
+
+// ParseExtendedClipboardLimit parses the payload of an extended cut text message,
+// the data of a provide message is decompressed up to max bytes, more data is ErrTooLarge
+func ParseExtendedClipboardLimit(payload []byte, max int) (*ExtendedClipboard, error) {
+	if len(payload) < 4 {
+		return nil, ErrMalformedClipboard
+	}
+	e := &ExtendedClipboard{Flags: binary.BigEndian.Uint32(payload)}
+	rest := payload[4:]
+	switch e.Action() {
+	case ClipboardCaps:
+		for format := uint32(1); format&clipboardFormats != 0; format <<= 1 {
+			if e.Flags&format == 0 {
+				continue
+			}
+			if len(rest) < 4 {
+				return nil, ErrMalformedClipboard
+			}
+			e.MaxSizes = append(e.MaxSizes, binary.BigEndian.Uint32(rest))
+			rest = rest[4:]
+		}
+	case ClipboardProvide:
+		zr, err := zlib.NewReader(bytes.NewReader(rest))
+		if err != nil {
+			return nil, ErrMalformedClipboard
+		}
+		defer zr.Close()
+		s := &stream{r: io.LimitReader(zr, int64(max)+1)}
+		e.Data = make(map[uint32][]byte)
+		for format := uint32(1); format&clipboardFormats != 0; format <<= 1 {
+			if e.Flags&format == 0 {
+				continue
+			}
+			n := s.u32()
+			if s.err == nil && uint64(n) > uint64(max) {
+				// checked before the data is buffered
+				return nil, ErrTooLarge
+			}
+			e.Data[format] = s.payload(uint64(n))
+			if s.err != nil {
+				if s.err == ErrTooLarge {
+					return nil, ErrTooLarge
+				}
+				return nil, ErrMalformedClipboard
+			}
+		}
+	}
+	return e, nil
+}
+
+// Bytes returns the payload of the extended cut text message, the data of a provide message is compressed
+func (e *ExtendedClipboard) Bytes() []byte {
+	w := &writer{}
+	w.u32(e.Flags)
+	switch e.Action() {
+	case ClipboardCaps:
+		for _, size := range e.MaxSizes {
+			w.u32(size)
+		}
+	case ClipboardProvide:
+		data := &writer{}
+		for format := uint32(1); format&clipboardFormats != 0; format <<= 1 {
+			if e.Flags&format == 0 {
+				continue
+			}
+			data.u32(uint32(len(e.Data[format])))
+			data.write(e.Data[format])
+		}
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data.b)
+		zw.Close()
+		w.write(buf.Bytes())
+	}
+	return w.b
+}
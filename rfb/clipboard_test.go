@@ -0,0 +1,95 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"reflect"
+	"testing"
+)
+
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestExtendedClipboard(t *testing.T) {
+	provide := &ExtendedClipboard{Flags: ClipboardProvide | ClipboardHTML}
+	provide.SetText("line 1\nline 2")
+	provide.Data[ClipboardHTML] = []byte("<b>x</b>")
+
+	tests := []struct {
+		name string
+		ec   *ExtendedClipboard
+	}{
+		{"caps", &ExtendedClipboard{Flags: ClipboardCaps | ClipboardText | ClipboardHTML, MaxSizes: []uint32{1 << 20, 1 << 10}}},
+		{"request", &ExtendedClipboard{Flags: ClipboardRequest | ClipboardText}},
+		{"peek", &ExtendedClipboard{Flags: ClipboardPeek}},
+		{"notify", &ExtendedClipboard{Flags: ClipboardNotify | ClipboardText}},
+		{"provide", provide},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExtendedClipboard(tt.ec.Bytes())
+			if err != nil {
+				t.Fatalf("ParseExtendedClipboard() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.ec) {
+				t.Fatalf("ParseExtendedClipboard() = %#v, want %#v", got, tt.ec)
+			}
+		})
+	}
+}
+
+func TestExtendedClipboardText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		data []byte
+		want string
+	}{
+		{"lf", "a\nb", []byte("a\r\nb\x00"), "a\nb"},
+		{"crlf", "a\r\nb", []byte("a\r\nb\x00"), "a\nb"},
+		{"utf-8", "日本語", []byte("日本語\x00"), "日本語"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ExtendedClipboard{Flags: ClipboardProvide}
+			e.SetText(tt.text)
+			if !bytes.Equal(e.Data[ClipboardText], tt.data) {
+				t.Fatalf("SetText() data = %q, want %q", e.Data[ClipboardText], tt.data)
+			}
+			text, ok := e.Text()
+			if !ok || text != tt.want {
+				t.Fatalf("Text() = %q, %v, want %q", text, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendedClipboardMalformed(t *testing.T) {
+	provideText := []byte{0x10, 0, 0, 1}
+	tests := []struct {
+		name    string
+		payload []byte
+		max     int
+		want    error
+	}{
+		{"short flags", []byte{0, 0}, MaxPayloadLength, ErrMalformedClipboard},
+		{"caps without sizes", []byte{1, 0, 0, 1}, MaxPayloadLength, ErrMalformedClipboard},
+		{"provide not compressed", append(provideText, "text"...), MaxPayloadLength, ErrMalformedClipboard},
+		{"provide truncated", append(provideText, compress([]byte{0, 0, 0, 9, 'a'})...), MaxPayloadLength, ErrMalformedClipboard},
+		{"provide above the limit", append(provideText, compress([]byte{0, 0, 0, 9, 'a'})...), 8, ErrTooLarge},
+		{"provide length above the limit", append(provideText, compress([]byte{0xff, 0xff, 0xff, 0xff})...), 8, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseExtendedClipboardLimit(tt.payload, tt.max)
+			if err != tt.want {
+				t.Fatalf("ParseExtendedClipboardLimit() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package rfb
+
+import "io"
+
+// encodings
+const (
+	EncodingRaw      int32 = 0
+	EncodingCopyRect int32 = 1
+	EncodingRRE      int32 = 2
+	EncodingCoRRE    int32 = 4
+	EncodingHextile  int32 = 5
+	EncodingZlib     int32 = 6
+	EncodingTight    int32 = 7
+	EncodingZRLE     int32 = 16
+	EncodingTightPNG int32 = -260
+)
+
+// pseudo-encodings
+const (
+	EncodingJPEGQuality0          int32 = -32
+	EncodingJPEGQuality9          int32 = -23
+	EncodingDesktopSize           int32 = -223
+	EncodingLastRect              int32 = -224
+	EncodingPointerPos            int32 = -232
+	EncodingCursor                int32 = -239
+	EncodingXCursor               int32 = -240
+	EncodingCompressLevel0        int32 = -256
+	EncodingCompressLevel9        int32 = -247
+	EncodingQEMUExtendedKeyEvent  int32 = -258
+	EncodingQEMUAudio             int32 = -259
+	EncodingQEMULEDState          int32 = -261
+	EncodingDesktopName           int32 = -307
+	EncodingExtendedDesktopSize   int32 = -308
+	EncodingXvp                   int32 = -309
+	EncodingFence                 int32 = -312
+	EncodingContinuousUpdates     int32 = -313
+	EncodingFineQualityLevel0     int32 = -512
+	EncodingFineQualityLevel100   int32 = -412
+	EncodingSubsampling1X         int32 = -768
+	EncodingSubsamplingGray       int32 = -763
+	EncodingExtendedClipboard     int32 = -1063131698 // 0xc0a1e5ce
+	EncodingVMwareLEDState        int32 = 0x574d5668
+	EncodingVMwareCursorWithAlpha int32 = 0x574d5664
+)
+
+// IsSupported reports whether the parser can frame what the server sends once the client
+// announced the encoding. A proxy should remove other encodings from SetEncodings.
+func IsSupported(encoding int32) bool {
+	switch {
+	case encoding >= EncodingJPEGQuality0 && encoding <= EncodingJPEGQuality9,
+		encoding >= EncodingCompressLevel0 && encoding <= EncodingCompressLevel9,
+		encoding >= EncodingFineQualityLevel0 && encoding <= EncodingFineQualityLevel100,
+		encoding >= EncodingSubsampling1X && encoding <= EncodingSubsamplingGray:
+		// only tune the server, nothing is sent for them
+		return true
+	}
+	switch encoding {
+	case EncodingRaw, EncodingCopyRect, EncodingRRE, EncodingCoRRE, EncodingHextile,
+		EncodingZlib, EncodingTight, EncodingZRLE, EncodingTightPNG,
+		EncodingDesktopSize, EncodingLastRect, EncodingPointerPos, EncodingCursor, EncodingXCursor,
+		EncodingQEMUExtendedKeyEvent, EncodingQEMUAudio, EncodingQEMULEDState,
+		EncodingDesktopName, EncodingExtendedDesktopSize, EncodingXvp, EncodingFence,
+		EncodingContinuousUpdates, EncodingExtendedClipboard, EncodingVMwareLEDState:
+		return true
+	}
+	return false
+}
+
+// hextile sub-encoding flags
+const (
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+)
+
+// tight compression control
+const (
+	tightFill       = 0x08
+	tightJPEG       = 0x09
+	tightPNG        = 0x0a
+	tightMaxSubtype = 0x0a
+
+	tightExplicitFilter = 0x40
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+
+	// data smaller than this is sent without compression and length
+	tightMinToCompress = 12
+)
+
+// readRectData reads the encoded payload of a rectangle and returns it as it was sent
+func readRectData(s *stream, r *Rectangle, pf PixelFormat) []byte {
+	rr := &recordingReader{r: s.r}
+	// the rectangle header was read already, so an EOF now means a truncated message
+	d := &stream{r: rr, n: 1}
+	w, h := int(r.Width), int(r.Height)
+	bpp := pf.BytesPerPixel()
+	switch r.Encoding {
+	case EncodingRaw:
+		d.skip(w * h * bpp)
+	case EncodingCopyRect:
+		d.skip(4)
+	case EncodingRRE:
+		n := d.u32()
+		d.skip(bpp)
+		d.payload(uint64(n) * uint64(bpp+8))
+	case EncodingCoRRE:
+		n := d.u32()
+		d.skip(bpp)
+		d.payload(uint64(n) * uint64(bpp+4))
+	case EncodingHextile:
+		readHextile(d, w, h, bpp)
+	case EncodingZlib, EncodingZRLE:
+		d.payload(uint64(d.u32()))
+	case EncodingTight, EncodingTightPNG:
+		readTight(d, w, h, pf.CompactPixelSize())
+	case EncodingDesktopSize, EncodingLastRect, EncodingPointerPos,
+		EncodingQEMUExtendedKeyEvent, EncodingQEMUAudio:
+	case EncodingCursor:
+		d.skip(w*h*bpp + (w+7)/8*h)
+	case EncodingXCursor:
+		if w*h > 0 {
+			d.skip(6 + 2*((w+7)/8*h))
+		}
+	case EncodingQEMULEDState:
+		d.skip(1)
+	case EncodingVMwareLEDState:
+		d.skip(4)
+	case EncodingDesktopName:
+		d.payload(uint64(d.u32()))
+	case EncodingExtendedDesktopSize:
+		n := int(d.u8())
+		d.skip(3 + 16*n)
+	default:
+		d.err = &UnsupportedError{What: "encoding", Value: r.Encoding}
+	}
+	if d.err != nil {
+		s.err = d.err
+		return nil
+	}
+	return rr.buf
+}
+
+func readHextile(d *stream, w, h, bpp int) {
+	for ty := 0; ty < h; ty += 16 {
+		th := min(16, h-ty)
+		for tx := 0; tx < w && d.err == nil; tx += 16 {
+			tw := min(16, w-tx)
+			sub := d.u8()
+			if sub&hextileRaw != 0 {
+				d.skip(tw * th * bpp)
+				continue
+			}
+			if sub&hextileBackgroundSpecified != 0 {
+				d.skip(bpp)
+			}
+			if sub&hextileForegroundSpecified != 0 {
+				d.skip(bpp)
+			}
+			if sub&hextileAnySubrects != 0 {
+				n := int(d.u8())
+				if sub&hextileSubrectsColoured != 0 {
+					d.skip(n * (bpp + 2))
+				} else {
+					d.skip(n * 2)
+				}
+			}
+		}
+	}
+}
+
+func readTight(d *stream, w, h, tpixel int) {
+	ctl := d.u8()
+	switch comp := ctl >> 4; {
+	case comp == tightFill:
+		d.skip(tpixel)
+		return
+	case comp == tightJPEG || comp == tightPNG:
+		d.payload(uint64(readCompactLength(d)))
+		return
+	case comp > tightMaxSubtype:
+		if d.err == nil {
+			d.err = &UnsupportedError{What: "encoding", Value: EncodingTight}
+		}
+		return
+	}
+	filter := uint8(tightFilterCopy)
+	if ctl&tightExplicitFilter != 0 {
+		filter = d.u8()
+	}
+	rowSize := w * tpixel
+	switch filter {
+	case tightFilterCopy, tightFilterGradient:
+	case tightFilterPalette:
+		n := int(d.u8()) + 1
+		d.skip(n * tpixel)
+		rowSize = w
+		if n == 2 {
+			rowSize = (w + 7) / 8
+		}
+	default:
+		if d.err == nil {
+			d.err = &UnsupportedError{What: "encoding", Value: EncodingTight}
+		}
+		return
+	}
+	if size := rowSize * h; size < tightMinToCompress {
+		d.skip(size)
+		return
+	}
+	d.payload(uint64(readCompactLength(d)))
+}
+
+// readCompactLength reads the 1 to 3 bytes length used by the Tight encoding
+func readCompactLength(d *stream) int {
+	b := d.u8()
+	length := int(b & 0x7f)
+	if b&0x80 != 0 {
+		b = d.u8()
+		length |= int(b&0x7f) << 7
+		if b&0x80 != 0 {
+			length |= int(d.u8()) << 14
+		}
+	}
+	return length
+}
+
+// recordingReader keeps a copy of everything read through it
+type recordingReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,504 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+var ErrMalformedRectangle = errors.New("rfb: malformed rectangle data")
+
+// Framebuffer is the screen of a session, decoded from the FramebufferUpdate messages of the server.
+// It decodes Raw, CopyRect, RRE, CoRRE, Hextile, Zlib, ZRLE, Tight and TightPNG rectangles
+// in true colour pixel formats, the Tight gradient filter needs 32 bits per pixel of depth 24.
+// A Framebuffer is not safe for concurrent use.
+type Framebuffer struct {
+	pf  PixelFormat
+	img *image.RGBA
+	// the zlib streams last for the whole connection
+	zlib  zstream
+	zrle  zstream
+	tight [4]zstream
+}
+
+// NewFramebuffer returns a black framebuffer of the size and pixel format of the ServerInit,
+// the pixel format must be updated when the client sends SetPixelFormat
+func NewFramebuffer(width, height int, pf PixelFormat) *Framebuffer {
+	fb := &Framebuffer{pf: pf, img: image.NewRGBA(image.Rect(0, 0, width, height))}
+	draw.Draw(fb.img, fb.img.Bounds(), image.Black, image.Point{}, draw.Src)
+	return fb
+}
+
+// SetPixelFormat changes the pixel format of the rectangles decoded later
+func (fb *Framebuffer) SetPixelFormat(pf PixelFormat) {
+	fb.pf = pf
+}
+
+// Width returns the width of the screen
+func (fb *Framebuffer) Width() int {
+	return fb.img.Bounds().Dx()
+}
+
+// Height returns the height of the screen
+func (fb *Framebuffer) Height() int {
+	return fb.img.Bounds().Dy()
+}
+
+// RGBAAt returns the colour of the pixel at x, y
+func (fb *Framebuffer) RGBAAt(x, y int) color.RGBA {
+	return fb.img.RGBAAt(x, y)
+}
+
+// Image returns a copy of the screen
+func (fb *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(fb.img.Bounds())
+	copy(img.Pix, fb.img.Pix)
+	return img
+}
+
+// Update draws the rectangles of m, DesktopSize and ExtendedDesktopSize resize the screen
+// and the other pseudo-encodings are ignored
+func (fb *Framebuffer) Update(m *FramebufferUpdate) error {
+	for i := range m.Rects {
+		if err := fb.decode(&m.Rects[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fb *Framebuffer) decode(r *Rectangle) error {
+	if !fb.pf.TrueColour {
+		switch r.Encoding {
+		case EncodingRaw, EncodingCopyRect, EncodingRRE, EncodingCoRRE, EncodingHextile,
+			EncodingZlib, EncodingZRLE, EncodingTight, EncodingTightPNG:
+			return &UnsupportedError{What: "colour map pixel format with encoding", Value: r.Encoding}
+		}
+	}
+	s := &stream{r: bytes.NewReader(r.Data)}
+	x, y, w, h := int(r.X), int(r.Y), int(r.Width), int(r.Height)
+	switch r.Encoding {
+	case EncodingRaw:
+		fb.decodeRaw(s, x, y, w, h)
+	case EncodingCopyRect:
+		sx, sy := int(s.u16()), int(s.u16())
+		draw.Draw(fb.img, image.Rect(x, y, x+w, y+h), fb.img, image.Pt(sx, sy), draw.Src)
+	case EncodingRRE:
+		n := s.u32()
+		fb.fill(x, y, w, h, fb.pixel(s))
+		for i := uint32(0); i < n && s.err == nil; i++ {
+			c := fb.pixel(s)
+			fb.fill(x+int(s.u16()), y+int(s.u16()), int(s.u16()), int(s.u16()), c)
+		}
+	case EncodingCoRRE:
+		n := s.u32()
+		fb.fill(x, y, w, h, fb.pixel(s))
+		for i := uint32(0); i < n && s.err == nil; i++ {
+			c := fb.pixel(s)
+			fb.fill(x+int(s.u8()), y+int(s.u8()), int(s.u8()), int(s.u8()), c)
+		}
+	case EncodingHextile:
+		fb.decodeHextile(s, x, y, w, h)
+	case EncodingZlib:
+		zr, err := fb.zlib.feed(s.payload(uint64(s.u32())))
+		if err != nil || s.err != nil {
+			return firstError(s.err, err)
+		}
+		zs := &stream{r: zr, n: 1}
+		fb.decodeRaw(zs, x, y, w, h)
+		return zs.err
+	case EncodingZRLE:
+		zr, err := fb.zrle.feed(s.payload(uint64(s.u32())))
+		if err != nil || s.err != nil {
+			return firstError(s.err, err)
+		}
+		return fb.decodeZRLE(&stream{r: zr, n: 1}, x, y, w, h)
+	case EncodingTight, EncodingTightPNG:
+		return fb.decodeTight(s, x, y, w, h)
+	case EncodingDesktopSize, EncodingExtendedDesktopSize:
+		fb.resize(w, h)
+	}
+	return s.err
+}
+
+func (fb *Framebuffer) decodeRaw(s *stream, x, y, w, h int) {
+	for j := 0; j < h && s.err == nil; j++ {
+		for i := 0; i < w; i++ {
+			fb.img.SetRGBA(x+i, y+j, fb.pixel(s))
+		}
+	}
+}
+
+func (fb *Framebuffer) decodeHextile(s *stream, x, y, w, h int) {
+	var bg, fg color.RGBA
+	for ty := 0; ty < h; ty += 16 {
+		th := min(16, h-ty)
+		for tx := 0; tx < w && s.err == nil; tx += 16 {
+			tw := min(16, w-tx)
+			sub := s.u8()
+			if sub&hextileRaw != 0 {
+				fb.decodeRaw(s, x+tx, y+ty, tw, th)
+				continue
+			}
+			if sub&hextileBackgroundSpecified != 0 {
+				bg = fb.pixel(s)
+			}
+			fb.fill(x+tx, y+ty, tw, th, bg)
+			if sub&hextileForegroundSpecified != 0 {
+				fg = fb.pixel(s)
+			}
+			if sub&hextileAnySubrects == 0 {
+				continue
+			}
+			n := int(s.u8())
+			for i := 0; i < n && s.err == nil; i++ {
+				c := fg
+				if sub&hextileSubrectsColoured != 0 {
+					c = fb.pixel(s)
+				}
+				xy, wh := s.u8(), s.u8()
+				fb.fill(x+tx+int(xy>>4), y+ty+int(xy&0xf), int(wh>>4)+1, int(wh&0xf)+1, c)
+			}
+		}
+	}
+}
+
+func (fb *Framebuffer) decodeZRLE(s *stream, x, y, w, h int) error {
+	for ty := 0; ty < h; ty += 64 {
+		th := min(64, h-ty)
+		for tx := 0; tx < w && s.err == nil; tx += 64 {
+			tw := min(64, w-tx)
+			if err := fb.decodeZRLETile(s, x+tx, y+ty, tw, th); err != nil {
+				return err
+			}
+		}
+	}
+	return s.err
+}
+
+func (fb *Framebuffer) decodeZRLETile(s *stream, x, y, w, h int) error {
+	sub := int(s.u8())
+	set := func(i int, c color.RGBA) {
+		fb.img.SetRGBA(x+i%w, y+i/w, c)
+	}
+	switch {
+	case sub == 0:
+		for i := 0; i < w*h && s.err == nil; i++ {
+			set(i, fb.compactPixel(s))
+		}
+	case sub == 1:
+		fb.fill(x, y, w, h, fb.compactPixel(s))
+	case sub <= 16:
+		palette := fb.palette(s, sub, fb.compactPixel)
+		bits := 4
+		if sub == 2 {
+			bits = 1
+		} else if sub <= 4 {
+			bits = 2
+		}
+		for j := 0; j < h && s.err == nil; j++ {
+			row := s.read((w*bits + 7) / 8)
+			for i := 0; i < w && row != nil; i++ {
+				index := int(row[i*bits/8]>>(8-bits-i*bits%8)) & (1<<bits - 1)
+				if index >= len(palette) {
+					return ErrMalformedRectangle
+				}
+				set(j*w+i, palette[index])
+			}
+		}
+	case sub == 128:
+		for i := 0; i < w*h && s.err == nil; {
+			c := fb.compactPixel(s)
+			for n := runLength(s); n > 0 && i < w*h; n-- {
+				set(i, c)
+				i++
+			}
+		}
+	case sub >= 130:
+		palette := fb.palette(s, sub-128, fb.compactPixel)
+		for i := 0; i < w*h && s.err == nil; {
+			index, n := int(s.u8()), 1
+			if index&128 != 0 {
+				index &= 127
+				n = runLength(s)
+			}
+			if index >= len(palette) {
+				return ErrMalformedRectangle
+			}
+			for ; n > 0 && i < w*h; n-- {
+				set(i, palette[index])
+				i++
+			}
+		}
+	default:
+		return ErrMalformedRectangle
+	}
+	return s.err
+}
+
+// runLength reads the run length of a ZRLE run, a sum of bytes ending with a byte other than 255
+func runLength(s *stream) int {
+	n := 1
+	for s.err == nil {
+		b := s.u8()
+		n += int(b)
+		if b != 255 {
+			break
+		}
+	}
+	return n
+}
+
+func (fb *Framebuffer) decodeTight(s *stream, x, y, w, h int) error {
+	ctl := s.u8()
+	for i := range fb.tight {
+		if ctl&(1<<uint(i)) != 0 {
+			fb.tight[i].reset()
+		}
+	}
+	switch comp := ctl >> 4; {
+	case comp == tightFill:
+		fb.fill(x, y, w, h, fb.tightPixel(s))
+		return s.err
+	case comp == tightJPEG || comp == tightPNG:
+		data := s.payload(uint64(readCompactLength(s)))
+		if s.err != nil {
+			return s.err
+		}
+		var (
+			img image.Image
+			err error
+		)
+		if comp == tightJPEG {
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		} else {
+			img, err = png.Decode(bytes.NewReader(data))
+		}
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, image.Rect(x, y, x+w, y+h), img, img.Bounds().Min, draw.Src)
+		return nil
+	case comp > tightMaxSubtype:
+		return ErrMalformedRectangle
+	}
+	filter := uint8(tightFilterCopy)
+	if ctl&tightExplicitFilter != 0 {
+		filter = s.u8()
+	}
+	tpixel := fb.pf.CompactPixelSize()
+	rowSize := w * tpixel
+	var palette []color.RGBA
+	switch filter {
+	case tightFilterCopy:
+	case tightFilterGradient:
+		if tpixel != 3 {
+			return &UnsupportedError{What: "tight gradient filter for bits per pixel", Value: int32(fb.pf.BPP)}
+		}
+	case tightFilterPalette:
+		palette = fb.palette(s, int(s.u8())+1, fb.tightPixel)
+		rowSize = w
+		if len(palette) == 2 {
+			rowSize = (w + 7) / 8
+		}
+	default:
+		return ErrMalformedRectangle
+	}
+	size := rowSize * h
+	var data []byte
+	if size < tightMinToCompress {
+		data = s.read(size)
+	} else {
+		zr, err := fb.tight[ctl>>4&3].feed(s.payload(uint64(readCompactLength(s))))
+		if err != nil || s.err != nil {
+			return firstError(s.err, err)
+		}
+		data = (&stream{r: zr, n: 1}).read(size)
+		if data == nil {
+			return ErrMalformedRectangle
+		}
+	}
+	if s.err != nil {
+		return s.err
+	}
+	d := &stream{r: bytes.NewReader(data)}
+	switch {
+	case filter == tightFilterGradient:
+		fb.tightGradient(data, x, y, w, h)
+	case palette != nil:
+		for j := 0; j < h; j++ {
+			row := data[j*rowSize:]
+			for i := 0; i < w; i++ {
+				var index int
+				if len(palette) == 2 {
+					index = int(row[i/8]>>(7-uint(i%8))) & 1
+				} else {
+					index = int(row[i])
+				}
+				if index >= len(palette) {
+					return ErrMalformedRectangle
+				}
+				fb.img.SetRGBA(x+i, y+j, palette[index])
+			}
+		}
+	default:
+		for j := 0; j < h; j++ {
+			for i := 0; i < w; i++ {
+				fb.img.SetRGBA(x+i, y+j, fb.tightPixel(d))
+			}
+		}
+	}
+	return nil
+}
+
+// tightGradient reverses the gradient filter, every colour component was sent
+// as the difference to its prediction from the left, upper and upper left pixels
+func (fb *Framebuffer) tightGradient(data []byte, x, y, w, h int) {
+	prev := make([]int, w*3)
+	row := make([]int, w*3)
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			for c := 0; c < 3; c++ {
+				var left, upperLeft int
+				if i > 0 {
+					left, upperLeft = row[(i-1)*3+c], prev[(i-1)*3+c]
+				}
+				prediction := left + prev[i*3+c] - upperLeft
+				if prediction < 0 {
+					prediction = 0
+				} else if prediction > 255 {
+					prediction = 255
+				}
+				row[i*3+c] = (prediction + int(data[(j*w+i)*3+c])) & 255
+			}
+			fb.img.SetRGBA(x+i, y+j, color.RGBA{R: uint8(row[i*3]), G: uint8(row[i*3+1]), B: uint8(row[i*3+2]), A: 255})
+		}
+		prev, row = row, prev
+	}
+}
+
+func (fb *Framebuffer) palette(s *stream, n int, pixel func(*stream) color.RGBA) []color.RGBA {
+	palette := make([]color.RGBA, 0, n)
+	for i := 0; i < n && s.err == nil; i++ {
+		palette = append(palette, pixel(s))
+	}
+	return palette
+}
+
+func (fb *Framebuffer) fill(x, y, w, h int, c color.RGBA) {
+	draw.Draw(fb.img, image.Rect(x, y, x+w, y+h), &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
+
+// resize change the size of the screen, keeping what stays visible
+func (fb *Framebuffer) resize(w, h int) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), fb.img, image.Point{}, draw.Src)
+	fb.img = img
+}
+
+// pixel reads a PIXEL value
+func (fb *Framebuffer) pixel(s *stream) color.RGBA {
+	b := s.read(fb.pf.BytesPerPixel())
+	var v uint32
+	for i := range b {
+		if fb.pf.BigEndian {
+			v = v<<8 | uint32(b[i])
+		} else {
+			v |= uint32(b[i]) << (8 * uint(i))
+		}
+	}
+	return fb.colour(v)
+}
+
+// compactPixel reads a CPIXEL value of ZRLE, the three least significant bytes of a PIXEL
+func (fb *Framebuffer) compactPixel(s *stream) color.RGBA {
+	if fb.pf.CompactPixelSize() != 3 {
+		return fb.pixel(s)
+	}
+	b := s.read(3)
+	if b == nil {
+		return color.RGBA{}
+	}
+	if fb.pf.BigEndian {
+		return fb.colour(uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]))
+	}
+	return fb.colour(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+}
+
+// tightPixel reads a TPIXEL value of Tight, which is sent as red, green and blue bytes
+// when a PIXEL has 8 bits per colour in 32 bits
+func (fb *Framebuffer) tightPixel(s *stream) color.RGBA {
+	if fb.pf.CompactPixelSize() != 3 {
+		return fb.pixel(s)
+	}
+	b := s.read(3)
+	if b == nil {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: b[0], G: b[1], B: b[2], A: 255}
+}
+
+// colour converts a true colour pixel value
+func (fb *Framebuffer) colour(v uint32) color.RGBA {
+	pf := fb.pf
+	return color.RGBA{
+		R: scaleColour(v>>pf.RedShift, pf.RedMax),
+		G: scaleColour(v>>pf.GreenShift, pf.GreenMax),
+		B: scaleColour(v>>pf.BlueShift, pf.BlueMax),
+		A: 255,
+	}
+}
+
+func scaleColour(v uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	v &= uint32(max)
+	if max == 255 {
+		return uint8(v)
+	}
+	return uint8(v * 255 / uint32(max))
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zstream inflates a zlib stream the server sends in chunks, one per rectangle.
+// The server flushes the stream at the end of every rectangle, so reading exactly
+// the uncompressed data of a rectangle never reads past its chunk.
+type zstream struct {
+	in bytes.Buffer
+	r  io.ReadCloser
+}
+
+// feed append the compressed chunk of a rectangle and returns the reader of the uncompressed data
+func (z *zstream) feed(chunk []byte) (io.Reader, error) {
+	z.in.Write(chunk)
+	if z.r == nil {
+		r, err := zlib.NewReader(&z.in)
+		if err != nil {
+			return nil, ErrMalformedRectangle
+		}
+		z.r = r
+	}
+	return z.r, nil
+}
+
+// reset start a new stream, as requested by the Tight compression control
+func (z *zstream) reset() {
+	z.in.Reset()
+	z.r = nil
+}
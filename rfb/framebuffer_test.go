@@ -0,0 +1,240 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image/color"
+	"io"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	black = color.RGBA{0, 0, 0, 255}
+)
+
+// pixel returns c in testPixelFormat
+func pixel(c color.RGBA) []byte {
+	return []byte{c.B, c.G, c.R, 0}
+}
+
+// cpixel returns c as compact 3 bytes pixel of testPixelFormat, as sent by ZRLE
+func cpixel(c color.RGBA) []byte {
+	return pixel(c)[:3]
+}
+
+// tpixel returns c as Tight sends the pixels of testPixelFormat, in red, green, blue order
+func tpixel(c color.RGBA) []byte {
+	return []byte{c.R, c.G, c.B}
+}
+
+// zlibStream compresses the chunks as the messages of one zlib stream, the chunks are flushed but not closed
+func zlibStream(chunks ...[]byte) [][]byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	var out [][]byte
+	for _, c := range chunks {
+		zw.Write(c)
+		zw.Flush()
+		out = append(out, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return out
+}
+
+// lengthPrefixed prefixes b with its length as u32
+func lengthPrefixed(b []byte) []byte {
+	return append(u32(uint32(len(b))), b...)
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+type point struct {
+	x, y int
+	c    color.RGBA
+}
+
+func TestFramebufferDecode(t *testing.T) {
+	zlibRaw := zlibStream(concat(pixel(red), pixel(green)))
+	// a 64x2 tile with plain RLE, a red run of 64 pixels and a green one, and a 6x2 tile
+	// with a packed palette, one bit per pixel
+	zrle := zlibStream(concat(
+		[]byte{128}, cpixel(red), []byte{63}, cpixel(green), []byte{63},
+		[]byte{2}, cpixel(blue), cpixel(red), []byte{0x54, 0xa8},
+	))
+	zrleSolid := zlibStream(concat([]byte{1}, cpixel(blue)))
+	// 2 colours, a row of 100 pixels is 13 bytes and compressed
+	tightRow := make([]byte, 13)
+	tightRow[0] = 0x80
+	tightPalette := zlibStream(tightRow)[0]
+	// every pixel is (10,20,30): only the first differs from its prediction
+	tightGradient := zlibStream([]byte{10, 20, 30, 0, 0, 0, 0, 0, 0, 0, 0, 0})[0]
+
+	tests := []struct {
+		name  string
+		pf    PixelFormat
+		rects []Rectangle
+		want  []point
+	}{
+		{
+			name:  "raw",
+			rects: []Rectangle{{X: 1, Y: 1, Width: 2, Height: 1, Encoding: EncodingRaw, Data: concat(pixel(red), pixel(green))}},
+			want:  []point{{0, 0, black}, {1, 1, red}, {2, 1, green}},
+		},
+		{
+			name:  "raw 16 bits",
+			pf:    PixelFormat{BPP: 16, Depth: 16, TrueColour: true, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5},
+			rects: []Rectangle{{Width: 3, Height: 1, Encoding: EncodingRaw, Data: []byte{0x00, 0xf8, 0xe0, 0x07, 0x1f, 0x00}}},
+			want:  []point{{0, 0, red}, {1, 0, green}, {2, 0, blue}},
+		},
+		{
+			name: "CopyRect",
+			rects: []Rectangle{
+				{Width: 2, Height: 1, Encoding: EncodingRaw, Data: concat(pixel(red), pixel(green))},
+				{X: 10, Y: 10, Width: 2, Height: 1, Encoding: EncodingCopyRect, Data: []byte{0, 0, 0, 0}},
+			},
+			want: []point{{10, 10, red}, {11, 10, green}},
+		},
+		{
+			name: "RRE",
+			rects: []Rectangle{{X: 10, Y: 10, Width: 10, Height: 10, Encoding: EncodingRRE,
+				Data: concat(u32(1), pixel(blue), pixel(red), []byte{0, 2, 0, 2, 0, 3, 0, 3})}},
+			want: []point{{10, 10, blue}, {12, 12, red}, {14, 14, red}, {15, 15, blue}, {20, 20, black}},
+		},
+		{
+			name: "CoRRE",
+			rects: []Rectangle{{X: 10, Y: 10, Width: 10, Height: 10, Encoding: EncodingCoRRE,
+				Data: concat(u32(1), pixel(blue), pixel(red), []byte{2, 2, 3, 3})}},
+			want: []point{{10, 10, blue}, {12, 12, red}, {15, 15, blue}},
+		},
+		{
+			name: "hextile",
+			// four tiles: background and foreground with a 2x2 subrect at 1,1, the previous background,
+			// the previous background and a raw tile
+			rects: []Rectangle{{X: 30, Y: 30, Width: 20, Height: 20, Encoding: EncodingHextile, Data: concat(
+				[]byte{hextileBackgroundSpecified | hextileForegroundSpecified | hextileAnySubrects}, pixel(green), pixel(red), []byte{1, 0x11, 0x11},
+				[]byte{0}, []byte{0},
+				[]byte{hextileRaw}, bytes.Repeat(pixel(blue), 4*4),
+			)}},
+			want: []point{{30, 30, green}, {31, 31, red}, {32, 32, red}, {33, 33, green}, {46, 30, green}, {30, 46, green}, {46, 46, blue}, {49, 49, blue}},
+		},
+		{
+			name:  "zlib",
+			rects: []Rectangle{{Width: 2, Height: 1, Encoding: EncodingZlib, Data: lengthPrefixed(zlibRaw[0])}},
+			want:  []point{{0, 0, red}, {1, 0, green}},
+		},
+		{
+			name: "ZRLE",
+			rects: []Rectangle{
+				{Y: 50, Width: 70, Height: 2, Encoding: EncodingZRLE, Data: lengthPrefixed(zrle[0])},
+			},
+			want: []point{{0, 50, red}, {63, 50, red}, {0, 51, green}, {64, 50, blue}, {65, 50, red}, {64, 51, red}, {65, 51, blue}},
+		},
+		{
+			name:  "ZRLE solid tile",
+			rects: []Rectangle{{Width: 5, Height: 5, Encoding: EncodingZRLE, Data: lengthPrefixed(zrleSolid[0])}},
+			want:  []point{{0, 0, blue}, {4, 4, blue}, {5, 5, black}},
+		},
+		{
+			name:  "tight fill",
+			rects: []Rectangle{{X: 80, Width: 5, Height: 5, Encoding: EncodingTight, Data: concat([]byte{tightFill << 4}, tpixel(green))}},
+			want:  []point{{80, 0, green}, {84, 4, green}, {85, 5, black}},
+		},
+		{
+			name:  "tight copy filter",
+			rects: []Rectangle{{Width: 2, Height: 1, Encoding: EncodingTight, Data: concat([]byte{0}, tpixel(red), tpixel(blue))}},
+			want:  []point{{0, 0, red}, {1, 0, blue}},
+		},
+		{
+			name: "tight palette",
+			rects: []Rectangle{{Y: 60, Width: 100, Height: 1, Encoding: EncodingTight, Data: concat(
+				[]byte{tightExplicitFilter | 1<<4, tightFilterPalette, 1}, tpixel(blue), tpixel(red), []byte{byte(len(tightPalette))}, tightPalette,
+			)}},
+			want: []point{{0, 60, red}, {1, 60, blue}, {99, 60, blue}},
+		},
+		{
+			name: "tight gradient",
+			rects: []Rectangle{{X: 90, Y: 90, Width: 2, Height: 2, Encoding: EncodingTight, Data: concat(
+				[]byte{tightExplicitFilter | 2<<4, tightFilterGradient, byte(len(tightGradient))}, tightGradient,
+			)}},
+			want: []point{{90, 90, color.RGBA{10, 20, 30, 255}}, {91, 91, color.RGBA{10, 20, 30, 255}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pf := tt.pf
+			if pf == (PixelFormat{}) {
+				pf = testPixelFormat
+			}
+			fu := &FramebufferUpdate{Rects: tt.rects}
+			// the rectangles must be framed by the reader as well
+			m, err := NewServerReader(bytes.NewReader(fu.Bytes()), pf).ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			fb := NewFramebuffer(100, 100, pf)
+			if err = fb.Update(m.(*FramebufferUpdate)); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			for _, p := range tt.want {
+				if got := fb.RGBAAt(p.x, p.y); got != p.c {
+					t.Errorf("RGBAAt(%d, %d) = %v, want %v", p.x, p.y, got, p.c)
+				}
+			}
+		})
+	}
+}
+
+func TestFramebufferZlibStream(t *testing.T) {
+	// the zlib stream continues across the rectangles of the connection
+	chunks := zlibStream(concat(pixel(red), pixel(red)), concat(pixel(green), pixel(green)))
+	fb := NewFramebuffer(2, 2, testPixelFormat)
+	for i, c := range chunks {
+		r := Rectangle{Y: uint16(i), Width: 2, Height: 1, Encoding: EncodingZlib, Data: lengthPrefixed(c)}
+		if err := fb.Update(&FramebufferUpdate{Rects: []Rectangle{r}}); err != nil {
+			t.Fatalf("Update() of rectangle %d error = %v", i, err)
+		}
+	}
+	if got := fb.RGBAAt(1, 1); got != green {
+		t.Fatalf("RGBAAt(1, 1) = %v, want %v", got, green)
+	}
+}
+
+func TestFramebufferResize(t *testing.T) {
+	fb := NewFramebuffer(100, 100, testPixelFormat)
+	err := fb.Update(&FramebufferUpdate{Rects: []Rectangle{{Width: 800, Height: 600, Encoding: EncodingDesktopSize}}})
+	if err != nil || fb.Width() != 800 || fb.Height() != 600 {
+		t.Fatalf("Update() = %v, size %dx%d, want 800x600", err, fb.Width(), fb.Height())
+	}
+}
+
+func TestFramebufferMalformed(t *testing.T) {
+	colourMap := PixelFormat{BPP: 8, Depth: 8}
+	tests := []struct {
+		name    string
+		pf      PixelFormat
+		rect    Rectangle
+		wantErr error
+	}{
+		{"colour map pixel format", colourMap, Rectangle{Width: 1, Height: 1, Encoding: EncodingRaw, Data: []byte{0}},
+			&UnsupportedError{What: "colour map pixel format with encoding", Value: EncodingRaw}},
+		{"truncated raw", testPixelFormat, Rectangle{Width: 2, Height: 1, Encoding: EncodingRaw, Data: pixel(red)}, io.ErrUnexpectedEOF},
+		{"tight compression above the maximum", testPixelFormat, Rectangle{Width: 1, Height: 1, Encoding: EncodingTight, Data: []byte{0xb0}}, ErrMalformedRectangle},
+		{"tight unknown filter", testPixelFormat, Rectangle{Width: 1, Height: 1, Encoding: EncodingTight, Data: []byte{tightExplicitFilter, 9}}, ErrMalformedRectangle},
+		{"tight palette index out of range", testPixelFormat, Rectangle{Width: 1, Height: 1, Encoding: EncodingTight,
+			Data: concat([]byte{tightExplicitFilter, tightFilterPalette, 2}, tpixel(red), tpixel(green), tpixel(blue), []byte{3})}, ErrMalformedRectangle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := NewFramebuffer(10, 10, tt.pf)
+			err := fb.Update(&FramebufferUpdate{Rects: []Rectangle{tt.rect}})
+			if err == nil || err.Error() != tt.wantErr.Error() {
+				t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
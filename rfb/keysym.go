@@ -0,0 +1,72 @@
+package rfb
+
+// keysyms of the keys without a character, as defined by X11
+const (
+	KeyBackSpace  uint32 = 0xff08
+	KeyTab        uint32 = 0xff09
+	KeyReturn     uint32 = 0xff0d
+	KeyPause      uint32 = 0xff13
+	KeyScrollLock uint32 = 0xff14
+	KeySysReq     uint32 = 0xff15
+	KeyEscape     uint32 = 0xff1b
+	KeyHome       uint32 = 0xff50
+	KeyLeft       uint32 = 0xff51
+	KeyUp         uint32 = 0xff52
+	KeyRight      uint32 = 0xff53
+	KeyDown       uint32 = 0xff54
+	KeyPageUp     uint32 = 0xff55
+	KeyPageDown   uint32 = 0xff56
+	KeyEnd        uint32 = 0xff57
+	KeyPrint      uint32 = 0xff61
+	KeyInsert     uint32 = 0xff63
+	KeyMenu       uint32 = 0xff67
+	KeyNumLock    uint32 = 0xff7f
+	KeyKPSpace    uint32 = 0xff80
+	KeyKPTab      uint32 = 0xff89
+	KeyKPEnter    uint32 = 0xff8d
+	// KeyKPMultiply to KeyKP9 are KP_Multiply, KP_Add, KP_Separator, KP_Subtract,
+	// KP_Decimal, KP_Divide and KP_0 to KP_9
+	KeyKPMultiply uint32 = 0xffaa
+	KeyKP0        uint32 = 0xffb0
+	KeyKP9        uint32 = 0xffb9
+	KeyF1         uint32 = 0xffbe
+	KeyF2         uint32 = 0xffbf
+	KeyF3         uint32 = 0xffc0
+	KeyF4         uint32 = 0xffc1
+	KeyF5         uint32 = 0xffc2
+	KeyF6         uint32 = 0xffc3
+	KeyF7         uint32 = 0xffc4
+	KeyF8         uint32 = 0xffc5
+	KeyF9         uint32 = 0xffc6
+	KeyF10        uint32 = 0xffc7
+	KeyF11        uint32 = 0xffc8
+	KeyF12        uint32 = 0xffc9
+	KeyShiftL     uint32 = 0xffe1
+	KeyShiftR     uint32 = 0xffe2
+	KeyControlL   uint32 = 0xffe3
+	KeyControlR   uint32 = 0xffe4
+	KeyCapsLock   uint32 = 0xffe5
+	KeyMetaL      uint32 = 0xffe7
+	KeyMetaR      uint32 = 0xffe8
+	KeyAltL       uint32 = 0xffe9
+	KeyAltR       uint32 = 0xffea
+	KeySuperL     uint32 = 0xffeb
+	KeySuperR     uint32 = 0xffec
+	KeyDelete     uint32 = 0xffff
+)
+
+// Keysym returns the keysym typing the character r. Latin-1 characters are their own keysyms,
+// the other characters use the Unicode keysyms, and \n, \t and \b are Return, Tab and BackSpace.
+func Keysym(r rune) uint32 {
+	switch {
+	case r == '\n':
+		return KeyReturn
+	case r == '\t':
+		return KeyTab
+	case r == '\b':
+		return KeyBackSpace
+	case r >= 0x20 && r <= 0x7e, r >= 0xa0 && r <= 0xff:
+		return uint32(r)
+	}
+	return 0x01000000 | uint32(r)
+}
@@ -0,0 +1,273 @@
+// Package rfb incrementally parses the messages of the RFB (VNC) protocol
+// exchanged after the handshake, so a proxy can relay them one by one
+// instead of copying opaque bytes.
+package rfb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// client to server message types
+const (
+	SetPixelFormatMsg           uint8 = 0
+	SetEncodingsMsg             uint8 = 2
+	FramebufferUpdateRequestMsg uint8 = 3
+	KeyEventMsg                 uint8 = 4
+	PointerEventMsg             uint8 = 5
+	ClientCutTextMsg            uint8 = 6
+	EnableContinuousUpdatesMsg  uint8 = 150
+	ClientFenceMsg              uint8 = 248
+	ClientXvpMsg                uint8 = 250
+	SetDesktopSizeMsg           uint8 = 251
+	GiiMsg                      uint8 = 253
+	QEMUClientMsg               uint8 = 255
+)
+
+// server to client message types
+const (
+	FramebufferUpdateMsg      uint8 = 0
+	SetColourMapEntriesMsg    uint8 = 1
+	BellMsg                   uint8 = 2
+	ServerCutTextMsg          uint8 = 3
+	EndOfContinuousUpdatesMsg uint8 = 150
+	ServerFenceMsg            uint8 = 248
+	ServerXvpMsg              uint8 = 250
+	QEMUServerMsg             uint8 = 255
+)
+
+// MaxPayloadLength limits the length of a single length-prefixed payload,
+// larger payloads are rejected with ErrTooLarge
+var MaxPayloadLength = 256 << 20
+
+// MaxClientCutTextLength is the default ClientReader.MaxCutText, the clients are not trusted
+// to send payloads as large as MaxPayloadLength
+var MaxClientCutTextLength = 1 << 20
+
+var ErrTooLarge = errors.New("rfb: payload too large")
+
+// UnsupportedError reports a message type or an encoding the parser cannot frame
+type UnsupportedError struct {
+	// What is "client message", "server message" or "encoding"
+	What  string
+	Value int32
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("rfb: unsupported %v %v", e.What, e.Value)
+}
+
+// Message is an RFB message exchanged after the handshake
+type Message interface {
+	// Type returns the message-type byte
+	Type() uint8
+	// Bytes returns the message in its wire format
+	Bytes() []byte
+}
+
+// PixelFormat describes how pixel values are sent on the wire
+type PixelFormat struct {
+	BPP        uint8
+	Depth      uint8
+	BigEndian  bool
+	TrueColour bool
+	RedMax     uint16
+	GreenMax   uint16
+	BlueMax    uint16
+	RedShift   uint8
+	GreenShift uint8
+	BlueShift  uint8
+}
+
+// BytesPerPixel returns the size of a PIXEL value
+func (pf PixelFormat) BytesPerPixel() int {
+	return int(pf.BPP) / 8
+}
+
+// CompactPixelSize returns the size of a CPIXEL (ZRLE, TRLE) or TPIXEL (Tight) value,
+// which is 3 bytes for 32 bits per pixel true colour formats of depth 24 or less
+func (pf PixelFormat) CompactPixelSize() int {
+	if pf.TrueColour && pf.BPP == 32 && pf.Depth <= 24 &&
+		uint32(pf.RedMax)<<pf.RedShift|uint32(pf.GreenMax)<<pf.GreenShift|uint32(pf.BlueMax)<<pf.BlueShift <= 0xffffff {
+		return 3
+	}
+	return pf.BytesPerPixel()
+}
+
+func (pf PixelFormat) bytes() []byte {
+	b := make([]byte, 16)
+	b[0], b[1] = pf.BPP, pf.Depth
+	b[2], b[3] = bool2byte(pf.BigEndian), bool2byte(pf.TrueColour)
+	binary.BigEndian.PutUint16(b[4:], pf.RedMax)
+	binary.BigEndian.PutUint16(b[6:], pf.GreenMax)
+	binary.BigEndian.PutUint16(b[8:], pf.BlueMax)
+	b[10], b[11], b[12] = pf.RedShift, pf.GreenShift, pf.BlueShift
+	return b
+}
+
+func parsePixelFormat(b []byte) PixelFormat {
+	return PixelFormat{
+		BPP:        b[0],
+		Depth:      b[1],
+		BigEndian:  b[2] != 0,
+		TrueColour: b[3] != 0,
+		RedMax:     binary.BigEndian.Uint16(b[4:]),
+		GreenMax:   binary.BigEndian.Uint16(b[6:]),
+		BlueMax:    binary.BigEndian.Uint16(b[8:]),
+		RedShift:   b[10],
+		GreenShift: b[11],
+		BlueShift:  b[12],
+	}
+}
+
+// ServerInit is the last message of the handshake, sent by the server after ClientInit
+type ServerInit struct {
+	Width       uint16
+	Height      uint16
+	PixelFormat PixelFormat
+	Name        string
+}
+
+// ReadServerInit reads a ServerInit message
+func ReadServerInit(r io.Reader) (*ServerInit, error) {
+	s := &stream{r: r}
+	b := s.read(20)
+	name := s.payload(uint64(s.u32()))
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &ServerInit{
+		Width:       binary.BigEndian.Uint16(b[0:]),
+		Height:      binary.BigEndian.Uint16(b[2:]),
+		PixelFormat: parsePixelFormat(b[4:]),
+		Name:        string(name),
+	}, nil
+}
+
+// Bytes returns the ServerInit message in its wire format
+func (si *ServerInit) Bytes() []byte {
+	w := &writer{}
+	w.u16(si.Width)
+	w.u16(si.Height)
+	w.write(si.PixelFormat.bytes())
+	w.u32(uint32(len(si.Name)))
+	w.write([]byte(si.Name))
+	return w.b
+}
+
+// stream reads big endian values, the first error is kept and later reads return zero values
+type stream struct {
+	r   io.Reader
+	err error
+	// n counts the bytes read, to tell a clean EOF between messages from a truncated message
+	n int
+}
+
+func (s *stream) read(n int) []byte {
+	if s.err != nil {
+		return nil
+	}
+	if n > MaxPayloadLength {
+		s.err = ErrTooLarge
+		return nil
+	}
+	b := make([]byte, n)
+	m, err := io.ReadFull(s.r, b)
+	s.n += m
+	if err != nil {
+		if err == io.EOF && s.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+		return nil
+	}
+	return b
+}
+
+func (s *stream) skip(n int) {
+	s.read(n)
+}
+
+// discard read and drop n bytes without buffering them
+func (s *stream) discard(n uint64) {
+	if s.err != nil {
+		return
+	}
+	m, err := io.CopyN(ioutil.Discard, s.r, int64(n))
+	s.n += int(m)
+	if err != nil {
+		if err == io.EOF && s.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+	}
+}
+
+func (s *stream) u8() uint8 {
+	b := s.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (s *stream) u16() uint16 {
+	b := s.read(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (s *stream) u32() uint32 {
+	b := s.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (s *stream) payload(n uint64) []byte {
+	if n > uint64(MaxPayloadLength) {
+		if s.err == nil {
+			s.err = ErrTooLarge
+		}
+		return nil
+	}
+	return s.read(int(n))
+}
+
+// writer appends big endian values
+type writer struct {
+	b []byte
+}
+
+func (w *writer) u8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *writer) u16(v uint16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *writer) u32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *writer) pad(n int) {
+	w.b = append(w.b, make([]byte, n)...)
+}
+
+func (w *writer) write(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+func bool2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
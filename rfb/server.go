@@ -0,0 +1,197 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Rectangle is a rectangle of a FramebufferUpdate,
+// Data holds its encoded payload exactly as it was sent
+type Rectangle struct {
+	X, Y, Width, Height uint16
+	Encoding            int32
+	Data                []byte
+}
+
+// FramebufferUpdate carries rectangles of pixel data and pseudo-encodings
+type FramebufferUpdate struct {
+	Rects []Rectangle
+}
+
+func (m *FramebufferUpdate) Type() uint8 { return FramebufferUpdateMsg }
+
+func (m *FramebufferUpdate) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.pad(1)
+	n := uint16(len(m.Rects))
+	if n > 0 && m.Rects[n-1].Encoding == EncodingLastRect {
+		n = 0xffff
+	}
+	w.u16(n)
+	for _, r := range m.Rects {
+		w.u16(r.X)
+		w.u16(r.Y)
+		w.u16(r.Width)
+		w.u16(r.Height)
+		w.u32(uint32(r.Encoding))
+		w.write(r.Data)
+	}
+	return w.b
+}
+
+// Colour is a colour map entry
+type Colour struct {
+	R, G, B uint16
+}
+
+// SetColourMapEntries sets colour map entries when the pixel format is not true colour
+type SetColourMapEntries struct {
+	FirstColour uint16
+	Colours     []Colour
+}
+
+func (m *SetColourMapEntries) Type() uint8 { return SetColourMapEntriesMsg }
+
+func (m *SetColourMapEntries) Bytes() []byte {
+	w := &writer{}
+	w.u8(m.Type())
+	w.pad(1)
+	w.u16(m.FirstColour)
+	w.u16(uint16(len(m.Colours)))
+	for _, c := range m.Colours {
+		w.u16(c.R)
+		w.u16(c.G)
+		w.u16(c.B)
+	}
+	return w.b
+}
+
+// Bell rings the bell of the client
+type Bell struct{}
+
+func (m *Bell) Type() uint8 { return BellMsg }
+
+func (m *Bell) Bytes() []byte { return []byte{BellMsg} }
+
+// ServerCutText sends the server clipboard as Latin-1 text.
+// With the Extended Clipboard pseudo-encoding the length is negative
+// and Text holds the extended clipboard payload instead.
+type ServerCutText struct {
+	Text     []byte
+	Extended bool
+}
+
+func (m *ServerCutText) Type() uint8 { return ServerCutTextMsg }
+
+func (m *ServerCutText) Bytes() []byte {
+	return cutTextBytes(m.Type(), m.Text, m.Extended)
+}
+
+// ServerReader reads server to client messages from a stream,
+// the pixel format is needed to frame the rectangles of a FramebufferUpdate
+type ServerReader struct {
+	r  io.Reader
+	l  sync.Mutex
+	pf PixelFormat
+}
+
+func NewServerReader(r io.Reader, pf PixelFormat) *ServerReader {
+	return &ServerReader{r: r, pf: pf}
+}
+
+// SetPixelFormat changes the pixel format once the client has sent SetPixelFormat to the server,
+// the FramebufferUpdates starting afterwards are read in the new format
+func (sr *ServerReader) SetPixelFormat(pf PixelFormat) {
+	sr.l.Lock()
+	sr.pf = pf
+	sr.l.Unlock()
+}
+
+// PixelFormat returns the pixel format used to frame rectangles
+func (sr *ServerReader) PixelFormat() PixelFormat {
+	sr.l.Lock()
+	defer sr.l.Unlock()
+	return sr.pf
+}
+
+// ReadMessage reads the next message, it returns io.EOF if the stream ends between two messages
+func (sr *ServerReader) ReadMessage() (Message, error) {
+	s := &stream{r: sr.r}
+	t := s.u8()
+	if s.err != nil {
+		return nil, s.err
+	}
+	var m Message
+	switch t {
+	case FramebufferUpdateMsg:
+		m = readFramebufferUpdate(s, sr.PixelFormat())
+	case SetColourMapEntriesMsg:
+		s.skip(1)
+		first := s.u16()
+		n := int(s.u16())
+		colours := make([]Colour, 0, n)
+		for i := 0; i < n && s.err == nil; i++ {
+			colours = append(colours, Colour{R: s.u16(), G: s.u16(), B: s.u16()})
+		}
+		m = &SetColourMapEntries{FirstColour: first, Colours: colours}
+	case BellMsg:
+		m = &Bell{}
+	case ServerCutTextMsg:
+		text, extended := readCutText(s)
+		m = &ServerCutText{Text: text, Extended: extended}
+	case EndOfContinuousUpdatesMsg:
+		m = &RawMessage{MsgType: t}
+	case ServerFenceMsg:
+		b := s.read(8)
+		if b != nil {
+			m = &RawMessage{MsgType: t, Data: append(b, s.read(int(b[7]))...)}
+		}
+	case ServerXvpMsg:
+		m = &RawMessage{MsgType: t, Data: s.read(3)}
+	case QEMUServerMsg:
+		// audio: operation 2 carries length prefixed sample data
+		b := s.read(3)
+		if b != nil {
+			if b[0] != 1 {
+				return nil, &UnsupportedError{What: "server message", Value: int32(QEMUServerMsg)<<8 | int32(b[0])}
+			}
+			if binary.BigEndian.Uint16(b[1:]) == 2 {
+				length := s.read(4)
+				if length != nil {
+					b = append(append(b, length...), s.payload(uint64(binary.BigEndian.Uint32(length)))...)
+				}
+			}
+			m = &RawMessage{MsgType: t, Data: b}
+		}
+	default:
+		return nil, &UnsupportedError{What: "server message", Value: int32(t)}
+	}
+	if s.err != nil {
+		if s.err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, s.err
+	}
+	return m, nil
+}
+
+func readFramebufferUpdate(s *stream, pf PixelFormat) Message {
+	s.skip(1)
+	n := int(s.u16())
+	m := &FramebufferUpdate{}
+	// with the LastRect pseudo-encoding the number of rectangles is 0xffff
+	for i := 0; (n == 0xffff || i < n) && s.err == nil; i++ {
+		r := Rectangle{X: s.u16(), Y: s.u16(), Width: s.u16(), Height: s.u16(), Encoding: int32(s.u32())}
+		if s.err != nil {
+			break
+		}
+		r.Data = readRectData(s, &r, pf)
+		m.Rects = append(m.Rects, r)
+		if r.Encoding == EncodingLastRect {
+			break
+		}
+	}
+	return m
+}
@@ -0,0 +1,152 @@
+package rfb
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// hextileRect is a 20x20 hextile rectangle of four tiles: raw, coloured subrects,
+// the previous background only and subrects in a new foreground colour
+func hextileRect() []byte {
+	b := []byte{hextileRaw}
+	b = append(b, make([]byte, 16*16*4)...)
+	b = append(b, hextileBackgroundSpecified|hextileForegroundSpecified|hextileAnySubrects|hextileSubrectsColoured, 1, 2, 3, 4, 5, 6, 7, 8, 2, 1, 1, 1, 1, 0, 0, 1, 1, 1, 1, 0, 0)
+	b = append(b, 0)
+	b = append(b, hextileForegroundSpecified|hextileAnySubrects, 1, 0, 0, 0, 1, 0, 0)
+	return b
+}
+
+func TestServerMessages(t *testing.T) {
+	tightPalette := []byte{0x40, 1, 1, 1, 2, 3, 4, 5, 6, 20}
+	tightPalette = append(tightPalette, make([]byte, 20)...)
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"raw", &FramebufferUpdate{Rects: []Rectangle{{Width: 2, Height: 2, Encoding: EncodingRaw, Data: make([]byte, 16)}}}},
+		{"CopyRect", &FramebufferUpdate{Rects: []Rectangle{{Width: 2, Height: 2, Encoding: EncodingCopyRect, Data: []byte{0, 1, 0, 2}}}}},
+		{"RRE", &FramebufferUpdate{Rects: []Rectangle{{Width: 4, Height: 4, Encoding: EncodingRRE, Data: append([]byte{0, 0, 0, 1, 9, 9, 9, 9}, make([]byte, 12)...)}}}},
+		{"hextile", &FramebufferUpdate{Rects: []Rectangle{{Width: 20, Height: 20, Encoding: EncodingHextile, Data: hextileRect()}}}},
+		{"tight fill", &FramebufferUpdate{Rects: []Rectangle{{Width: 20, Height: 20, Encoding: EncodingTight, Data: []byte{0x80, 1, 2, 3}}}}},
+		{"tight palette", &FramebufferUpdate{Rects: []Rectangle{{Width: 20, Height: 20, Encoding: EncodingTight, Data: tightPalette}}}},
+		{"ZRLE", &FramebufferUpdate{Rects: []Rectangle{{Width: 2, Height: 2, Encoding: EncodingZRLE, Data: []byte{0, 0, 0, 2, 1, 2}}}}},
+		{"pseudo-encodings and LastRect", &FramebufferUpdate{Rects: []Rectangle{
+			{Width: 800, Height: 600, Encoding: EncodingDesktopSize},
+			{Encoding: EncodingDesktopName, Data: []byte{0, 0, 0, 2, 'v', 'm'}},
+			{Encoding: EncodingLastRect},
+		}}},
+		{"SetColourMapEntries", &SetColourMapEntries{FirstColour: 1, Colours: []Colour{{1, 2, 3}}}},
+		{"Bell", &Bell{}},
+		{"ServerCutText", &ServerCutText{Text: []byte("server")}},
+		{"extended ServerCutText", &ServerCutText{Text: []byte("extended"), Extended: true}},
+		{"ServerFence", &RawMessage{MsgType: ServerFenceMsg, Data: []byte{0, 0, 0, 0, 0, 0, 0, 1, 7}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.msg.Bytes()
+			r := NewServerReader(bytes.NewReader(b), testPixelFormat)
+			got, err := r.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("ReadMessage() = %#v, want %#v", got, tt.msg)
+			}
+			if _, err = r.ReadMessage(); err != io.EOF {
+				t.Fatalf("ReadMessage() after the message error = %v, want io.EOF", err)
+			}
+
+			for n := 1; n < len(b); n++ {
+				_, err := NewServerReader(bytes.NewReader(b[:n]), testPixelFormat).ReadMessage()
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("ReadMessage() of %d of %d bytes error = %v, want io.ErrUnexpectedEOF", n, len(b), err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerMessagesMalformed(t *testing.T) {
+	tooLong := []byte{ServerCutTextMsg, 0, 0, 0}
+	tooLong = append(tooLong, u32(uint32(MaxPayloadLength)+1)...)
+	unknownEncoding := (&FramebufferUpdate{Rects: []Rectangle{{Width: 1, Height: 1, Encoding: 1234}}}).Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"unknown message type", []byte{99}, &UnsupportedError{What: "server message", Value: 99}},
+		{"unknown encoding", unknownEncoding, &UnsupportedError{What: "encoding", Value: 1234}},
+		{"unknown QEMU sub-type", []byte{QEMUServerMsg, 2, 0, 0}, &UnsupportedError{What: "server message", Value: int32(QEMUServerMsg)<<8 | 2}},
+		{"cut text above MaxPayloadLength", tooLong, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServerReader(bytes.NewReader(tt.data), testPixelFormat).ReadMessage()
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerReaderSetPixelFormat(t *testing.T) {
+	pf8 := PixelFormat{BPP: 8, Depth: 8, TrueColour: true, RedMax: 7, GreenMax: 7, BlueMax: 3, GreenShift: 3, BlueShift: 6}
+	update := func(bpp int) []byte {
+		rect := Rectangle{Width: 2, Height: 1, Encoding: EncodingRaw, Data: make([]byte, 2*bpp)}
+		return (&FramebufferUpdate{Rects: []Rectangle{rect}}).Bytes()
+	}
+	tests := []struct {
+		name string
+		// before are the updates read before SetPixelFormat, after the updates read after it
+		before [][]byte
+		after  [][]byte
+	}{
+		{"before any update", nil, [][]byte{update(1), update(1)}},
+		{"between updates", [][]byte{update(4)}, [][]byte{update(1)}},
+		// an update of an outstanding incremental request, the server sends it in the new format
+		// once it received SetPixelFormat
+		{"outstanding request", [][]byte{update(4), update(4)}, [][]byte{update(1), (&Bell{}).Bytes()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewServerReader(bytes.NewReader(bytes.Join(append(tt.before, tt.after...), nil)), testPixelFormat)
+			for i := range tt.before {
+				if _, err := r.ReadMessage(); err != nil {
+					t.Fatalf("ReadMessage() of message %d error = %v", i, err)
+				}
+			}
+			r.SetPixelFormat(pf8)
+			if r.PixelFormat() != pf8 {
+				t.Fatalf("PixelFormat() = %v, want the format set last", r.PixelFormat())
+			}
+			for i, b := range tt.after {
+				msg, err := r.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() of message %d after SetPixelFormat error = %v", i, err)
+				}
+				if !bytes.Equal(msg.Bytes(), b) {
+					t.Fatalf("ReadMessage() of message %d after SetPixelFormat = %x, want %x", i, msg.Bytes(), b)
+				}
+			}
+			if _, err := r.ReadMessage(); err != io.EOF {
+				t.Fatalf("ReadMessage() after the updates error = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestServerInit(t *testing.T) {
+	si := &ServerInit{Width: 1024, Height: 768, PixelFormat: testPixelFormat, Name: "vm"}
+	b := si.Bytes()
+	got, err := ReadServerInit(bytes.NewReader(b))
+	if err != nil || !reflect.DeepEqual(got, si) {
+		t.Fatalf("ReadServerInit() = %#v, %v, want %#v", got, err, si)
+	}
+	if _, err = ReadServerInit(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Fatal("ReadServerInit() of a truncated ServerInit succeeded")
+	}
+}
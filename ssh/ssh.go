@@ -1,11 +1,21 @@
+// Package ssh opens the ssh clients the proxy tunnels backend connections through.
+//
+// The host key of the ssh server is always verified: NewSSHClient fails with ErrNoHostKey
+// unless SSHClientConfig.HostKey is set. Configurations written before the host key was verified
+// connected without it, they must add the HostKey of the server, or set InsecureIgnoreHostKey
+// to keep connecting without verification, which allows man-in-the-middle attacks.
 package ssh
 
 import (
+	"errors"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrNoHostKey is returned when neither HostKey nor InsecureIgnoreHostKey is set
+var ErrNoHostKey = errors.New("ssh host key is not configured, set HostKey or InsecureIgnoreHostKey")
+
 type AuthModel int8
 
 const (
@@ -19,14 +29,30 @@ type SSHClientConfig struct {
 	User       string
 	Password   string
 	PrivateKey string
-	Timeout    time.Duration
+	// HostKey is the public key of the host in authorized_keys format, e.g. "ssh-ed25519 AAAA...",
+	// it is required unless InsecureIgnoreHostKey is set
+	HostKey string
+	// InsecureIgnoreHostKey connects without verifying the host key, which allows man-in-the-middle attacks
+	InsecureIgnoreHostKey bool
+	Timeout               time.Duration
 }
 
 func NewSSHClient(conf *SSHClientConfig) (*ssh.Client, error) {
 	config := &ssh.ClientConfig{
-		Timeout:         conf.Timeout,
-		User:            conf.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //忽略know_hosts检查
+		Timeout: conf.Timeout,
+		User:    conf.User,
+	}
+	switch {
+	case conf.HostKey != "":
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey))
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	case conf.InsecureIgnoreHostKey:
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey() //忽略know_hosts检查
+	default:
+		return nil, ErrNoHostKey
 	}
 	switch conf.AuthModel {
 	case PASSWORD: